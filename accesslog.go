@@ -0,0 +1,285 @@
+package kish
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+var ErrUnknownAccessLogFormat = errors.New("unknown access log format")
+
+// 訪問者のリクエスト1件
+type AccessLogEntry struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	RemoteIP string    `json:"remoteIP"`
+	// Basic認証やログインページのユーザー名、OIDCのメールアドレス
+	User   string `json:"user,omitempty"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Proto  string `json:"proto"`
+	Status int    `json:"status"`
+	Bytes  int64  `json:"bytes"`
+	// 秒
+	Duration  float64 `json:"duration"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"userAgent,omitempty"`
+}
+
+// 空ならcombined
+func CheckAccessLogFormat(format string) error {
+	switch format {
+	case "", AccessLogCombined, AccessLogJSON:
+		return nil
+	}
+	return fmt.Errorf("%w `%s`", ErrUnknownAccessLogFormat, format)
+}
+
+// 改行は含まない。Combined Log Formatにはホスト名と処理時間の欄がないので、必要ならjsonを使う
+func (e *AccessLogEntry) Format(format string) ([]byte, error) {
+	if err := CheckAccessLogFormat(format); err != nil {
+		return nil, err
+	}
+	if format == AccessLogJSON {
+		return json.Marshal(e)
+	}
+	return []byte(e.combined()), nil
+}
+
+func (e *AccessLogEntry) combined() string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprint(e.Bytes)
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s "%s" "%s"`,
+		e.RemoteIP, clfEscape(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		clfEscape(e.Method), clfEscape(e.Path), clfEscape(e.Proto),
+		e.Status, size, clfEscape(e.Referer), clfEscape(e.UserAgent))
+}
+
+// Apacheと同じく"と\と制御文字をエスケープする。空なら"-"
+func clfEscape(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// サーバーでトンネルごとのアクセスログをファイルに書く場合の設定
+type AccessLogConfig struct {
+	// <Dir>/<ホスト名>.logに書く
+	Dir string
+	// combinedかjson
+	Format string
+	// 0ならAuditLogと同じデフォルト値
+	MaxSize    int64
+	MaxBackups int
+	// ランダムなホスト名のファイルが溜まらないように、これより長く更新されていないファイルは消す。0なら30日
+	MaxAge time.Duration
+
+	lastCleanup atomic.Int64
+	cleanupMu   sync.Mutex
+}
+
+const (
+	defaultAccessLogMaxAge   = 30 * 24 * time.Hour
+	accessLogCleanupInterval = time.Hour
+)
+
+// 設定されていなければnil
+func (c *AccessLogConfig) open(host string) *AuditLog {
+	if c == nil || c.Dir == "" {
+		return nil
+	}
+	return &AuditLog{
+		Path:       filepath.Join(c.Dir, host+".log"),
+		MaxSize:    c.MaxSize,
+		MaxBackups: c.MaxBackups,
+	}
+}
+
+// ディレクトリが大きくなるのでトンネルを開くたびには読まない。TokenSet.maybeReloadと同じく間隔を空け、重ねて走らせない
+func (c *AccessLogConfig) maybeRemoveOld(now time.Time, suffix string, inUse func(host string) bool) {
+	if c == nil || c.Dir == "" {
+		return
+	}
+	if now.UnixNano()-c.lastCleanup.Load() < int64(accessLogCleanupInterval) {
+		return
+	}
+	if !c.cleanupMu.TryLock() {
+		return
+	}
+	defer c.cleanupMu.Unlock()
+	if now.UnixNano()-c.lastCleanup.Load() < int64(accessLogCleanupInterval) {
+		return
+	}
+	c.lastCleanup.Store(now.UnixNano())
+	c.removeOld(now, suffix, inUse)
+}
+
+// <ホスト名>.logか<ホスト名>.log.Nならホスト名を返す。他のログを同じディレクトリに置いていても消さないように、
+// ホスト名はトンネルのドメインで終わるものに限る
+func accessLogHost(name string, suffix string) (string, bool) {
+	host, n, _ := strings.Cut(name, ".log")
+	if n != "" {
+		digits, ok := strings.CutPrefix(n, ".")
+		if !ok || digits == "" || strings.Trim(digits, "0123456789") != "" {
+			return "", false
+		}
+	}
+	if suffix == "" || !strings.HasSuffix(host, suffix) || host == suffix {
+		return "", false
+	}
+	return host, true
+}
+
+// Dirの中の古い<ホスト名>.logとそのバックアップを消す。使用中のトンネルのものは長く書かれていなくても残す
+func (c *AccessLogConfig) removeOld(now time.Time, suffix string, inUse func(host string) bool) {
+	maxAge := c.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultAccessLogMaxAge
+	}
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		slog.Warn("AccessLog: failed to read the directory", "dir", c.Dir, "err", err)
+		return
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		host, ok := accessLogHost(e.Name(), suffix)
+		if !ok || inUse(host) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || now.Sub(info.ModTime()) <= maxAge {
+			continue
+		}
+		os.Remove(filepath.Join(c.Dir, e.Name()))
+	}
+}
+
+// ステータスと送ったバイト数を覚えておく
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	// 1xxの後に本当のステータスが来る場合がある
+	if w.status < 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// websocketの中継で使う
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	return hj.Hijack()
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// authorizeが通った後に呼ぶ。Basic認証以外のユーザー名はauthorizeがX-Forwarded-Userに入れている。
+// 認証のないトンネルではX-Forwarded-Userは訪問者が付けてきたものなので使わない
+func (p *proxy2Struct) visitorUser(req *http.Request) string {
+	if !p.requiresAuth() {
+		return ""
+	}
+	if user := req.Header.Get("X-Forwarded-User"); user != "" {
+		return user
+	}
+	if len(p.basicAuth) > 0 {
+		if user, _, ok := req.BasicAuth(); ok {
+			return user
+		}
+	}
+	return ""
+}
+
+// 記録するパス。トークンを渡すクエリは除く。/.kish/以下のクエリには署名やチケットが入るので丸ごと除く
+func (p *proxy2Struct) accessLogPath(req *http.Request) string {
+	u := *req.URL
+	if strings.HasPrefix(u.Path, kishReservedPathPrefix) {
+		u.RawQuery = ""
+	}
+	for _, ta := range p.tokenAuth {
+		if ta.Query != "" {
+			u.RawQuery = removeQueryParam(u.RawQuery, ta.Query)
+		}
+	}
+	return u.RequestURI()
+}
+
+func (p *proxy2Struct) logAccess(req *http.Request, w *accessLogWriter, remoteIP string, user string, start time.Time) {
+	if p.accessLog == nil && !p.streamAccessLog {
+		return
+	}
+	e := &AccessLogEntry{
+		Time:      start,
+		Host:      p.host,
+		RemoteIP:  remoteIP,
+		User:      user,
+		Method:    req.Method,
+		Path:      p.accessLogPath(req),
+		Proto:     req.Proto,
+		Status:    w.status,
+		Bytes:     w.bytes,
+		Duration:  time.Since(start).Seconds(),
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	if p.accessLog != nil {
+		if b, err := e.Format(p.accessLogFormat); err == nil {
+			p.accessLog.writeLine(b)
+		}
+	}
+	if p.streamAccessLog {
+		p.events.send(TunnelEvent{Type: EventAccess, RemoteIP: remoteIP, Message: e.combined(), Access: e})
+	}
+}
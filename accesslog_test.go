@@ -0,0 +1,289 @@
+package kish
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+func TestAccessLogEntryFormat(t *testing.T) {
+	e := &AccessLogEntry{
+		Time:      time.Date(2026, 10, 1, 12, 34, 56, 0, time.FixedZone("", 9*60*60)),
+		Host:      "a.kish.example.com",
+		RemoteIP:  "192.0.2.1",
+		User:      "alice",
+		Method:    "GET",
+		Path:      "/search?q=\"x\"",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Bytes:     1234,
+		Duration:  0.5,
+		UserAgent: "curl/8.0\n",
+	}
+	b, err := e.Format("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `192.0.2.1 - alice [01/Oct/2026:12:34:56 +0900] "GET /search?q=\"x\" HTTP/1.1" 200 1234 "-" "curl/8.0\x0a"`
+	if string(b) != want {
+		t.Errorf("combined:\n got %s\nwant %s", b, want)
+	}
+
+	b, err = e.Format(AccessLogJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got AccessLogEntry
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Host != e.Host || got.Duration != e.Duration || got.Path != e.Path || !got.Time.Equal(e.Time) {
+		t.Errorf("json: %s", b)
+	}
+
+	if _, err := e.Format("common"); err == nil {
+		t.Errorf("unknown format should be rejected")
+	}
+}
+
+// クライアント側の代わりにターゲットとして応答する
+func serveTarget(session *yamux.Session) {
+	for {
+		conn, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				return
+			}
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Request:       req,
+				Header:        http.Header{},
+				ContentLength: 5,
+				Body:          io.NopCloser(strings.NewReader("hello")),
+			}
+			resp.Write(conn)
+		}()
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	server, err := yamux.Server(serverSide, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := yamux.Client(clientSide, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go serveTarget(client)
+
+	dir := t.TempDir()
+	conf := &AccessLogConfig{Dir: dir, Format: AccessLogJSON}
+	p := &proxy2Struct{
+		host:            "a.kish.example.com",
+		basicAuth:       map[string]string{"alice": "secret"},
+		tokenAuth:       []TokenAuth{{Query: "token", Value: "t0ken"}},
+		limiter:         newAuthLimiter(),
+		events:          newEventSink(),
+		session:         server,
+		accessLog:       conf.open("a.kish.example.com"),
+		accessLogFormat: conf.Format,
+		streamAccessLog: true,
+	}
+	p.ipset.Add("0.0.0.0/0")
+	defer p.accessLog.Close()
+
+	for _, c := range []struct {
+		url  string
+		auth bool
+		code int
+	}{
+		{"/private", false, http.StatusUnauthorized},
+		{"/private?a=1&token=t0ken", false, http.StatusOK},
+		{"/private", true, http.StatusOK},
+		{"/.kish/share?sig=xxx", false, http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "http://a.kish.example.com"+c.url, nil)
+		req.RemoteAddr = "192.0.2.1:12345"
+		if c.auth {
+			req.SetBasicAuth("alice", "secret")
+		}
+		rec := httptest.NewRecorder()
+		p.normalHandler(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("%s: code = %d", c.url, rec.Code)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "a.kish.example.com.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []AccessLogEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e AccessLogEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %q", err, sc.Text())
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("entries: %+v", entries)
+	}
+	if e := entries[0]; e.Status != http.StatusUnauthorized || e.User != "" || e.RemoteIP != "192.0.2.1" || e.Host != "a.kish.example.com" {
+		t.Errorf("unauthorized: %+v", e)
+	}
+	// トークンはログに残さない
+	if e := entries[1]; e.Status != http.StatusOK || e.Path != "/private?a=1" || e.Bytes != 5 {
+		t.Errorf("token: %+v", e)
+	}
+	if e := entries[2]; e.User != "alice" {
+		t.Errorf("basic auth: %+v", e)
+	}
+	if e := entries[3]; e.Path != "/.kish/share" {
+		t.Errorf("share: %+v", e)
+	}
+
+	for i := range entries {
+		select {
+		case ev := <-p.events.ch:
+			if ev.Type != EventAccess || ev.Access == nil || ev.Access.Status != entries[i].Status {
+				t.Errorf("event: %+v", ev)
+			}
+		default:
+			t.Fatalf("event #%d is not sent", i)
+		}
+	}
+}
+
+func TestAccessLogVisitorUser(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://a.kish.example.com/", nil)
+	req.Header.Set("X-Forwarded-User", "forged")
+	// 認証のないトンネルでは訪問者の付けたヘッダーを信じない
+	p := &proxy2Struct{}
+	if user := p.visitorUser(req); user != "" {
+		t.Errorf("forged user is logged: %s", user)
+	}
+}
+
+func TestAccessLogFiles(t *testing.T) {
+	dir := t.TempDir()
+	conf := &AccessLogConfig{Dir: dir, MaxAge: time.Hour}
+	now := time.Now()
+	files := map[string]bool{
+		"old.kish.example.com.log":    true,
+		"old.kish.example.com.log.1":  true,
+		"busy.kish.example.com.log":   false,
+		"kish-server.log":             false,
+		"kish-server.log.1":           false,
+		"audit.log":                   false,
+		"old.kish.example.com.log.x":  false,
+		"old.kish.example.com.logs":   false,
+		"other.example.org.log":       false,
+		"new.kish.example.com.log":    false,
+		"new.kish.example.com.log.10": false,
+	}
+	for name := range files {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte("x\n"), 0600)
+		if !strings.HasPrefix(name, "new.") {
+			os.Chtimes(p, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+		}
+	}
+	// 使用中のトンネルのファイルは長く書かれていなくても消さない
+	inUse := func(host string) bool { return host == "busy.kish.example.com" }
+	conf.maybeRemoveOld(now, ".kish.example.com", inUse)
+	for name, removed := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err != nil) != removed {
+			t.Errorf("%s: removed = %v", name, err != nil)
+		}
+	}
+	// 間隔を空けずに呼んでもディレクトリは読まない
+	os.WriteFile(filepath.Join(dir, "old.kish.example.com.log"), nil, 0600)
+	os.Chtimes(filepath.Join(dir, "old.kish.example.com.log"), now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	conf.maybeRemoveOld(now.Add(time.Minute), ".kish.example.com", inUse)
+	if _, err := os.Stat(filepath.Join(dir, "old.kish.example.com.log")); err != nil {
+		t.Errorf("cleanup is not throttled")
+	}
+
+	l := conf.open("a.kish.example.com")
+	l.writeLine([]byte("a"))
+	l.Close()
+	// Closeの後に書いても開き直さない
+	path := filepath.Join(dir, "a.kish.example.com.log")
+	os.Remove(path)
+	l.writeLine([]byte("b"))
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("log is reopened after Close")
+	}
+}
+
+func TestAccessLogStreamLongPath(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	server, err := yamux.Server(serverSide, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := yamux.Client(clientSide, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	p := &proxy2Struct{
+		host:            "a.kish.example.com",
+		limiter:         newAuthLimiter(),
+		events:          newEventSink(),
+		session:         server,
+		streamAccessLog: true,
+	}
+	p.ipset.Add("0.0.0.0/0")
+	go p.events.serve(server)
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan TunnelEvent, 2)
+	go ReadTunnelEvents(stream, func(ev TunnelEvent) { received <- ev })
+	go serveTarget(client)
+
+	// bufio.Scannerの上限の64KiBを超えても、その後のイベントが止まらないこと
+	long := "/" + strings.Repeat("a", 100*1024)
+	for _, path := range []string{long, "/next"} {
+		req := httptest.NewRequest("GET", "http://a.kish.example.com"+path, nil)
+		req.RemoteAddr = "192.0.2.1:12345"
+		p.normalHandler(httptest.NewRecorder(), req)
+	}
+	for _, want := range []string{long, "/next"} {
+		select {
+		case ev := <-received:
+			if ev.Access == nil || ev.Access.Path != want {
+				t.Errorf("unexpected event: %.100v", ev.Access)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event for %.20s is not received", want)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package kish
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrAccountExists   = errors.New("account already exists")
+	ErrAccountNotFound = errors.New("account not found")
+)
+
+// 生成する共有秘密鍵のバイト数
+const secretSize = 32
+
+func GenerateSecret() (string, error) {
+	b := make([]byte, secretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func IsValidKeyID(keyID string) bool {
+	return keyIDRegexp.MatchString(keyID)
+}
+
+// kish-server accountで使う。コメントを残すためにyaml.Nodeのまま編集する
+type AccountFile struct {
+	Path string
+	doc  *yaml.Node
+	mode os.FileMode
+}
+
+// ファイルがなければ空として扱い、Saveで作る
+func OpenAccountFile(path string) (*AccountFile, error) {
+	f := &AccountFile{Path: path, mode: 0600}
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if stat, err := os.Stat(path); err == nil {
+			f.mode = stat.Mode().Perm()
+		}
+		var doc yaml.Node
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+		if doc.Kind == yaml.DocumentNode {
+			f.doc = &doc
+		}
+	}
+	if f.doc == nil {
+		f.doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if f.root().Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: top level must be a mapping", path)
+	}
+	return f, nil
+}
+
+func (f *AccountFile) root() *yaml.Node {
+	return f.doc.Content[0]
+}
+
+// キーの位置。なければ-1
+func mappingIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+}
+
+func timeNode(t time.Time) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!timestamp", Value: t.UTC().Format(time.RFC3339)}
+}
+
+func setField(m *yaml.Node, key string, value *yaml.Node) {
+	if i := mappingIndex(m, key); i >= 0 {
+		value.LineComment = m.Content[i+1].LineComment
+		m.Content[i+1] = value
+		return
+	}
+	m.Content = append(m.Content, scalarNode(key), value)
+}
+
+func deleteField(m *yaml.Node, key string) {
+	if i := mappingIndex(m, key); i >= 0 {
+		m.Content = slices.Delete(m.Content, i, i+2)
+	}
+}
+
+// 記載順に返す
+func (f *AccountFile) Accounts() ([]string, map[string]*Account, error) {
+	var m map[string]*Account
+	if err := f.root().Decode(&m); err != nil {
+		return nil, nil, err
+	}
+	var keyIDs []string
+	for i := 0; i < len(f.root().Content); i += 2 {
+		keyIDs = append(keyIDs, f.root().Content[i].Value)
+	}
+	return keyIDs, m, nil
+}
+
+// アカウントの値のノード。古い形式("keyID: secret")ならマッピングに書き換えてから返す
+func (f *AccountFile) accountNode(keyID string) (*yaml.Node, error) {
+	i := mappingIndex(f.root(), keyID)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrAccountNotFound, keyID)
+	}
+	v := f.root().Content[i+1]
+	if v.Kind == yaml.ScalarNode {
+		secret := scalarNode(v.Value)
+		secret.LineComment = v.LineComment
+		v = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{scalarNode("secret"), secret}}
+		f.root().Content[i+1] = v
+	}
+	if v.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("account %s: unexpected format", keyID)
+	}
+	return v, nil
+}
+
+// 秘密鍵だけなら古い形式で書く
+func (f *AccountFile) Add(keyID string, a *Account) error {
+	if !IsValidKeyID(keyID) {
+		return ErrInvalidKeyID
+	}
+	if mappingIndex(f.root(), keyID) >= 0 {
+		return fmt.Errorf("%w: %s", ErrAccountExists, keyID)
+	}
+	if len(a.Secrets) != 1 {
+		return errors.New("exactly one secret is required")
+	}
+	var v *yaml.Node
+	if a.Name == "" && a.Expires.IsZero() && a.Features == nil && a.AllowIP == nil && !a.Disabled {
+		v = scalarNode(a.Secrets[0])
+	} else {
+		v = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		setField(v, "secret", scalarNode(a.Secrets[0]))
+		if a.Name != "" {
+			setField(v, "name", scalarNode(a.Name))
+		}
+		if !a.Expires.IsZero() {
+			setField(v, "expires", timeNode(a.Expires))
+		}
+		if a.Features != nil {
+			features := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Style: yaml.FlowStyle}
+			for _, feature := range a.Features {
+				features.Content = append(features.Content, scalarNode(feature))
+			}
+			setField(v, "features", features)
+		}
+		if a.AllowIP != nil {
+			allowIP := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			for _, cidr := range a.AllowIP {
+				allowIP.Content = append(allowIP.Content, scalarNode(cidr))
+			}
+			setField(v, "allow-ip", allowIP)
+		}
+		if a.Disabled {
+			setField(v, "disabled", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: "true"})
+		}
+	}
+	f.root().Content = append(f.root().Content, scalarNode(keyID), v)
+	return nil
+}
+
+func (f *AccountFile) SetDisabled(keyID string, disabled bool) error {
+	v, err := f.accountNode(keyID)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		setField(v, "disabled", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: "true"})
+	} else {
+		deleteField(v, "disabled")
+	}
+	return nil
+}
+
+// 新しい鍵をkeysに加え、今ある鍵はoverlap後に使えなくする。
+// secret, secretsに書かれていた鍵はバージョンをつけてkeysに移す。新しい鍵のバージョンを返す
+func (f *AccountFile) Rotate(keyID string, secret string, now time.Time, overlap time.Duration) (string, error) {
+	v, err := f.accountNode(keyID)
+	if err != nil {
+		return "", err
+	}
+	var a Account
+	if err := v.Decode(&a); err != nil {
+		return "", err
+	}
+	keys := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	if i := mappingIndex(v, "keys"); i >= 0 {
+		keys = v.Content[i+1]
+	}
+	versions := map[string]bool{}
+	for _, k := range a.Keys {
+		versions[k.Version] = true
+	}
+	// 空いている一番小さい番号
+	nextVersion := func() string {
+		for n := len(versions) + 1; ; n++ {
+			if s := strconv.Itoa(n); !versions[s] {
+				versions[s] = true
+				return s
+			}
+		}
+	}
+	// コメントが残るようにノードごと移す
+	var olds []*yaml.Node
+	if i := mappingIndex(v, "secret"); i >= 0 {
+		olds = append(olds, v.Content[i+1])
+	}
+	if i := mappingIndex(v, "secrets"); i >= 0 {
+		olds = append(olds, v.Content[i+1].Content...)
+	}
+	for _, old := range olds {
+		k := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		setField(k, "version", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Style: yaml.DoubleQuotedStyle, Value: nextVersion()})
+		k.Content = append(k.Content, scalarNode("secret"), old)
+		keys.Content = append(keys.Content, k)
+	}
+	deleteField(v, "secret")
+	deleteField(v, "secrets")
+
+	notAfter := now.Add(overlap).Truncate(time.Second)
+	for _, k := range keys.Content {
+		var ak AccountKey
+		if err := k.Decode(&ak); err != nil {
+			return "", err
+		}
+		if ak.NotAfter.IsZero() || ak.NotAfter.After(notAfter) {
+			setField(k, "not-after", timeNode(notAfter))
+		}
+	}
+	version := nextVersion()
+	k := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setField(k, "version", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Style: yaml.DoubleQuotedStyle, Value: version})
+	setField(k, "secret", scalarNode(secret))
+	keys.Content = append(keys.Content, k)
+	setField(v, "keys", keys)
+	return version, nil
+}
+
+// 委任トークンのIDを無効にする。親アカウントの鍵を替えなくても済む
+func (f *AccountFile) RevokeDelegation(keyID string, tokenID string) error {
+	v, err := f.accountNode(keyID)
+	if err != nil {
+		return err
+	}
+	revoked := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	if i := mappingIndex(v, "revoked-delegations"); i >= 0 {
+		revoked = v.Content[i+1]
+	}
+	for _, n := range revoked.Content {
+		if n.Value == tokenID {
+			return nil
+		}
+	}
+	revoked.Content = append(revoked.Content, scalarNode(tokenID))
+	setField(v, "revoked-delegations", revoked)
+	return nil
+}
+
+func (f *AccountFile) Remove(keyID string) error {
+	i := mappingIndex(f.root(), keyID)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrAccountNotFound, keyID)
+	}
+	f.root().Content = slices.Delete(f.root().Content, i, i+2)
+	return nil
+}
+
+// サーバーが書き込み途中のファイルを読まないように、一時ファイルに書いてからrenameする
+func (f *AccountFile) Save() error {
+	_, m, err := f.Accounts()
+	if err != nil {
+		return err
+	}
+	if err := validateAccounts(m); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(f.doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(f.mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
@@ -0,0 +1,132 @@
+package kish
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAccountFileYAML = `# kishのアカウント
+user1: b554d3617be92f7c2449d8465534b54c # 開発用
+# 外注先
+contractor:
+  secret: 98dbb0b86bd8a3c9dfa6b47d28320c75
+  name: Contractor
+`
+
+func TestAccountFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "account.yaml")
+	os.WriteFile(path, []byte(testAccountFileYAML), 0640)
+	f, err := OpenAccountFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Add("ci", &Account{Secrets: []string{"s1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Add("web", &Account{Secrets: []string{"s2"}, Name: "Web", Features: []string{FeatureHTTP}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Add("user1", &Account{Secrets: []string{"s3"}}); !errors.Is(err, ErrAccountExists) {
+		t.Errorf("duplicate account is added: %v", err)
+	}
+	if err := f.Add("../x", &Account{Secrets: []string{"s3"}}); err != ErrInvalidKeyID {
+		t.Errorf("invalid key ID is accepted: %v", err)
+	}
+	if err := f.SetDisabled("user1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.RevokeDelegation("web", "token-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Remove("contractor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Remove("nobody"); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("unexpected: %v", err)
+	}
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := os.ReadFile(path)
+	for _, s := range []string{"# kishのアカウント", "# 開発用", "ci: s1\n"} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("%q is not in the file:\n%s", s, b)
+		}
+	}
+	if stat, _ := os.Stat(path); stat.Mode().Perm() != 0640 {
+		t.Errorf("mode is changed: %s", stat.Mode())
+	}
+	ts := &TokenSet{Path: path}
+	if a := ts.Get("user1"); a == nil || !a.Disabled || a.Secrets[0] != "b554d3617be92f7c2449d8465534b54c" {
+		t.Errorf("user1: %+v", a)
+	}
+	if a := ts.Get("web"); a == nil || a.Name != "Web" || a.Allows(FeatureTCP, true) || len(a.RevokedDelegations) != 1 {
+		t.Errorf("web: %+v", a)
+	}
+	if ts.Get("contractor") != nil {
+		t.Errorf("contractor is not removed")
+	}
+}
+
+func TestAccountFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "account.yaml")
+	f, err := OpenAccountFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Add("user1", &Account{Secrets: []string{"old"}})
+	now := time.Now()
+	if v, err := f.Rotate("user1", "new", now, time.Hour); err != nil || v != "2" {
+		t.Fatalf("Rotate: %q %v", v, err)
+	}
+	if v, err := f.Rotate("user1", "newer", now, 2*time.Hour); err != nil || v != "3" {
+		t.Fatalf("Rotate: %q %v", v, err)
+	}
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	a := (&TokenSet{Path: path}).Get("user1")
+	if a == nil || len(a.Secrets) != 0 || len(a.Keys) != 3 {
+		t.Fatalf("unexpected: %+v", a)
+	}
+	for _, c := range []struct {
+		secret  string
+		version string
+		at      time.Time
+		ok      bool
+	}{
+		{"old", "1", now, true},
+		{"old", "", now, true},
+		{"old", "1", now.Add(time.Hour), false},
+		{"new", "2", now.Add(time.Hour), true},
+		{"new", "2", now.Add(2 * time.Hour), false},
+		{"newer", "3", now.Add(24 * time.Hour), true},
+	} {
+		keys, _ := a.keys("user1", c.version, c.at)
+		found := false
+		for _, k := range keys {
+			found = found || string(k.([]byte)) == c.secret
+		}
+		if found != c.ok {
+			t.Errorf("%s/%s at %s: %v", c.secret, c.version, c.at, found)
+		}
+	}
+}
+
+func TestAccountFileRejectsInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "account.yaml")
+	os.WriteFile(path, []byte(testAccountFileYAML), 0600)
+	f, _ := OpenAccountFile(path)
+	f.Add("bad", &Account{Secrets: []string{"s"}, Features: []string{"ftp"}})
+	if err := f.Save(); err == nil {
+		t.Errorf("invalid account is saved")
+	}
+	if b, _ := os.ReadFile(path); string(b) != testAccountFileYAML {
+		t.Errorf("file is changed:\n%s", b)
+	}
+}
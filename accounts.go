@@ -1,75 +1,402 @@
 package kish
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
-type TokenSet struct {
-	Path    string
-	ModTime time.Time
-	Tokens  *map[string]string
+// アカウントに許可する機能
+const (
+	FeatureHTTP       = "http"
+	FeatureTCP        = "tcp"
+	FeatureUDP        = "udp"
+	FeatureTLS        = "tls"
+	FeatureCustomHost = "custom-host"
+)
+
+var knownFeatures = []string{FeatureHTTP, FeatureTCP, FeatureUDP, FeatureTLS, FeatureCustomHost}
+
+var (
+	ErrAccountDisabled    = errors.New("account is disabled")
+	ErrAccountExpired     = errors.New("account has expired")
+	ErrKeyVersionNotFound = errors.New("key version not found")
+	ErrKeyNotYetValid     = errors.New("key is not valid yet")
+	ErrKeyExpired         = errors.New("key has expired")
+	ErrRemoteIPNotAllowed = errors.New("remote IP is not allowed for this account")
+)
+
+// アカウントファイルの1件。値が文字列だけの古い形式("keyID: secret")はSecretsが1つのものとして読む
+type Account struct {
+	// 共有秘密鍵か"pubkey:"で始まる公開鍵。ローテーションのため複数書ける
+	Secrets []string `yaml:"secrets" json:"secrets"`
+	// 有効期間つきの鍵。トークンのkeyVersionで選ばれる
+	Keys     []AccountKey `yaml:"keys" json:"keys"`
+	Name     string       `yaml:"name" json:"name"`
+	Disabled bool         `yaml:"disabled" json:"disabled"`
+	// この時刻以降は使えない
+	Expires time.Time `yaml:"expires" json:"expires"`
+	// 省略した場合はサーバーの設定(EnableTCPForwardingなど)に従う
+	Features []string          `yaml:"features" json:"features"`
+	Labels   map[string]string `yaml:"labels" json:"labels"`
+	// トンネルを張れる接続元のCIDR。空ならどこからでもよい
+	AllowIP []string `yaml:"allow-ip" json:"allow-ip"`
+	// 無効にした委任トークンのID
+	RevokedDelegations []string `yaml:"revoked-delegations" json:"revoked-delegations"`
 }
 
-func loadStringStringMapYAML(f *os.File) (*map[string]string, time.Time, error) {
-	stat, err := f.Stat()
-	if err != nil {
-		return nil, time.Time{}, err
+// 新しい鍵を古い鍵の期限より前から有効にしておけば、クライアントを順に切り替えられる
+type AccountKey struct {
+	Version string `yaml:"version" json:"version"`
+	// 共有秘密鍵か"pubkey:"で始まる公開鍵
+	Secret string `yaml:"secret" json:"secret"`
+	// どちらも省略できる
+	NotBefore time.Time `yaml:"not-before" json:"not-before"`
+	NotAfter  time.Time `yaml:"not-after" json:"not-after"`
+}
+
+func (k *AccountKey) check(now time.Time) error {
+	if !k.NotBefore.IsZero() && now.Before(k.NotBefore) {
+		return ErrKeyNotYetValid
+	}
+	if !k.NotAfter.IsZero() && !now.Before(k.NotAfter) {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+func (a *Account) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var secret string
+		if err := node.Decode(&secret); err != nil {
+			return err
+		}
+		*a = Account{Secrets: []string{secret}}
+		return nil
+	}
+	// 1つだけならsecretと書けるようにする
+	type plain Account
+	var v struct {
+		plain  `yaml:",inline"`
+		Secret string `yaml:"secret"`
+	}
+	if err := node.Decode(&v); err != nil {
+		return err
+	}
+	*a = Account(v.plain)
+	if v.Secret != "" {
+		a.Secrets = append([]string{v.Secret}, a.Secrets...)
+	}
+	return nil
+}
+
+// HTTPKeyStoreの応答。YAMLと同じくsecretと書ける
+func (a *Account) UnmarshalJSON(b []byte) error {
+	type plain Account
+	var v struct {
+		plain
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*a = Account(v.plain)
+	if v.Secret != "" {
+		a.Secrets = append([]string{v.Secret}, a.Secrets...)
+	}
+	return nil
+}
+
+func (a *Account) validate() error {
+	if len(a.Secrets) == 0 && len(a.Keys) == 0 {
+		return errors.New("no secret")
+	}
+	var ipset IPSet
+	for _, cidr := range a.AllowIP {
+		if err := ipset.Add(cidr); err != nil {
+			return fmt.Errorf("allow-ip: %w", err)
+		}
+	}
+	versions := map[string]bool{}
+	for _, k := range a.Keys {
+		if k.Version == "" || k.Secret == "" {
+			return errors.New("key without version or secret")
+		}
+		if versions[k.Version] {
+			return fmt.Errorf("duplicate key version `%s`", k.Version)
+		}
+		versions[k.Version] = true
+		if !k.NotBefore.IsZero() && !k.NotAfter.IsZero() && !k.NotBefore.Before(k.NotAfter) {
+			return fmt.Errorf("key version `%s`: not-after must be after not-before", k.Version)
+		}
+	}
+	for _, f := range a.Features {
+		if !slices.Contains(knownFeatures, f) {
+			return fmt.Errorf("unknown feature `%s`", f)
+		}
+	}
+	return nil
+}
+
+// 認証に使えない状態ならエラーを返す
+func (a *Account) usable(now time.Time) error {
+	if a.Disabled {
+		return ErrAccountDisabled
+	}
+	if !a.Expires.IsZero() && !now.Before(a.Expires) {
+		return ErrAccountExpired
+	}
+	return nil
+}
+
+// AllowIPに含まれるか。書き損じたCIDRは無視する
+func (a *Account) allowsRemoteIP(remoteIP string) bool {
+	if len(a.AllowIP) == 0 {
+		return true
+	}
+	var ipset IPSet
+	for _, cidr := range a.AllowIP {
+		ipset.Add(cidr)
+	}
+	return ipset.ContainsIPString(remoteIP)
+}
+
+// Featuresを省略したアカウントはdefaultValueに従う
+func (a *Account) Allows(feature string, defaultValue bool) bool {
+	if a.Features == nil {
+		return defaultValue
+	}
+	return slices.Contains(a.Features, feature)
+}
+
+// 検証に使える鍵。共有秘密鍵なら[]byte、公開鍵ならcrypto.PublicKey。
+// versionを指定しなければSecretsと今有効なKeysのすべて
+func (a *Account) keys(keyID string, version string, now time.Time) ([]interface{}, error) {
+	var secrets []string
+	if version == "" {
+		secrets = append(secrets, a.Secrets...)
+		for _, k := range a.Keys {
+			if k.check(now) == nil {
+				secrets = append(secrets, k.Secret)
+			}
+		}
+	} else {
+		k := a.key(version)
+		if k == nil {
+			return nil, ErrKeyVersionNotFound
+		}
+		if err := k.check(now); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, k.Secret)
+	}
+	var keys []interface{}
+	for _, secret := range secrets {
+		if !strings.HasPrefix(secret, PublicKeyPrefix) {
+			keys = append(keys, []byte(secret))
+			continue
+		}
+		pub, err := ParsePublicKeyString(secret)
+		if err != nil {
+			slog.Warn("TokenSet: public key is invalid", "account", keyID, "err", err)
+			continue
+		}
+		keys = append(keys, pub)
 	}
+	return keys, nil
+}
+
+func (a *Account) key(version string) *AccountKey {
+	for i := range a.Keys {
+		if a.Keys[i].Version == version {
+			return &a.Keys[i]
+		}
+	}
+	return nil
+}
+
+// この鍵で認証できなくなる時刻。期限がなければゼロ値
+func (a *Account) keyExpires(version string) time.Time {
+	expires := a.Expires
+	if k := a.key(version); k != nil && !k.NotAfter.IsZero() {
+		if expires.IsZero() || k.NotAfter.Before(expires) {
+			expires = k.NotAfter
+		}
+	}
+	return expires
+}
+
+const defaultTokenSetCheckInterval = 5 * time.Second
+
+// アカウントファイルの内容。読み込むたびに新しく作り、差し替える
+type accountSnapshot struct {
+	accounts map[string]*Account
+	modTime  time.Time
+	size     int64
+}
+
+// 以前のTokensとModTimeフィールドはなくなった。読み込んだ内容はCurrentで、更新時刻はStatusで得る
+type TokenSet struct {
+	Path string
+	// ファイルの更新を確認する間隔。0ならdefaultTokenSetCheckInterval
+	CheckInterval time.Duration
+	// Pathが空の場合はこれを使う
+	Accounts map[string]*Account
+
+	snapshot  atomic.Pointer[accountSnapshot]
+	lastCheck atomic.Int64
+	reloadMu  sync.Mutex
+	// 同じ壊れたファイルを何度も読んでログを埋めないように覚えておく。reloadMuで守る
+	failedModTime time.Time
+	failedSize    int64
+	loadErrors    atomic.Uint64
+	lastError     atomic.Pointer[error]
+}
+
+type TokenSetStatus struct {
+	Accounts int
+	ModTime  time.Time
+	// 読み込みに失敗した回数と最後のエラー。失敗しても前回の内容を使い続ける
+	LoadErrors uint64
+	LastError  error
+}
+
+func loadAccountsYAML(f *os.File) (map[string]*Account, error) {
 	b, err := io.ReadAll(f)
 	if err != nil {
-		return nil, time.Time{}, err
+		return nil, err
 	}
-	var m map[string]string
+	var m map[string]*Account
 	err = yaml.Unmarshal(b, &m)
 	if err != nil {
-		return nil, time.Time{}, err
+		return nil, err
+	}
+	// 書き込み途中で空になっているのを読んだ場合。本当に空にするなら{}と書く
+	if m == nil {
+		return nil, errors.New("no accounts")
+	}
+	if err := validateAccounts(m); err != nil {
+		return nil, err
 	}
-	return &m, stat.ModTime(), nil
+	return m, nil
+}
+
+func validateAccounts(m map[string]*Account) error {
+	for keyID, a := range m {
+		if a == nil {
+			return fmt.Errorf("account %s: empty", keyID)
+		}
+		if err := a.validate(); err != nil {
+			return fmt.Errorf("account %s: %w", keyID, err)
+		}
+	}
+	return nil
+}
+
+// ファイルが更新されていれば読み込む。サーバーの起動時に呼べば設定の誤りに早く気付ける
+func (ts *TokenSet) Load() error {
+	ts.reloadMu.Lock()
+	defer ts.reloadMu.Unlock()
+	ts.lastCheck.Store(time.Now().UnixNano())
+	return ts.reload()
 }
 
-func (ts *TokenSet) ensureLoaded() {
-	var err error
-	defer func() {
+// reloadMuを取ってから呼ぶこと
+func (ts *TokenSet) reload() error {
+	err := func() error {
+		f, err := os.Open(ts.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if old := ts.snapshot.Load(); old != nil && old.modTime.Equal(stat.ModTime()) && old.size == stat.Size() {
+			return nil
+		}
+		if ts.failedModTime.Equal(stat.ModTime()) && ts.failedSize == stat.Size() {
+			return nil
+		}
+		m, err := loadAccountsYAML(f)
 		if err != nil {
-			log.Printf("TokenSet loadStringStringMapYAML: %s", err)
+			ts.failedModTime, ts.failedSize = stat.ModTime(), stat.Size()
+			return err
 		}
+		ts.snapshot.Store(&accountSnapshot{accounts: m, modTime: stat.ModTime(), size: stat.Size()})
+		slog.Info("TokenSet was successfully loaded", "path", ts.Path, "accounts", len(m))
+		return nil
 	}()
-	if ts.Path == "" {
-		return
-	}
-	f, err := os.Open(ts.Path)
 	if err != nil {
+		ts.loadErrors.Add(1)
+		ts.lastError.Store(&err)
+		status := ts.Status()
+		slog.Error("TokenSet: failed to load, keeping accounts loaded before", "path", ts.Path,
+			"errors", status.LoadErrors, "kept", status.Accounts, "loaded_mod_time", status.ModTime, "err", err)
+	}
+	return err
+}
+
+// 毎回statするのは重いのでCheckIntervalごとにする。読み込み中の他のリクエストは待たずに前の内容を使う
+func (ts *TokenSet) maybeReload(now time.Time) {
+	interval := ts.CheckInterval
+	if interval == 0 {
+		interval = defaultTokenSetCheckInterval
+	}
+	if now.UnixNano()-ts.lastCheck.Load() < int64(interval) {
 		return
 	}
-	defer f.Close()
-	stat, err := f.Stat()
-	if err != nil {
+	if ts.snapshot.Load() == nil {
+		// まだ一度も読めていないなら読み終わるのを待つ
+		ts.reloadMu.Lock()
+	} else if !ts.reloadMu.TryLock() {
 		return
 	}
-	if !ts.ModTime.Equal(stat.ModTime()) {
-		m, modtime, err := loadStringStringMapYAML(f)
-		if err != nil {
-			return
-		}
-		ts.Tokens = m
-		ts.ModTime = modtime
-		log.Printf("TokenSet was successfully loaded from %s", ts.Path)
+	defer ts.reloadMu.Unlock()
+	if now.UnixNano()-ts.lastCheck.Load() < int64(interval) {
+		return
 	}
+	ts.lastCheck.Store(now.UnixNano())
+	ts.reload()
 }
 
-func (ts *TokenSet) Get(keyID string) []byte {
-	ts.ensureLoaded()
-	if ts.Tokens == nil {
-		return nil
+func (ts *TokenSet) Get(keyID string) *Account {
+	return ts.Current()[keyID]
+}
+
+// 今使っているアカウント。呼び出し側で書き換えないこと
+func (ts *TokenSet) Current() map[string]*Account {
+	if ts.Path == "" {
+		return ts.Accounts
 	}
-	key := (*ts.Tokens)[keyID]
-	if key == "" {
+	ts.maybeReload(time.Now())
+	s := ts.snapshot.Load()
+	if s == nil {
 		return nil
 	}
-	return []byte(key)
+	return s.accounts
+}
+
+func (ts *TokenSet) Status() TokenSetStatus {
+	var status TokenSetStatus
+	if s := ts.snapshot.Load(); s != nil {
+		status.Accounts = len(s.accounts)
+		status.ModTime = s.modTime
+	}
+	status.LoadErrors = ts.loadErrors.Load()
+	if err := ts.lastError.Load(); err != nil {
+		status.LastError = *err
+	}
+	return status
 }
@@ -0,0 +1,292 @@
+package kish
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testAccountsYAML = `
+user1: b554d3617be92f7c2449d8465534b54c
+contractor:
+  secret: 98dbb0b86bd8a3c9dfa6b47d28320c75
+  name: Contractor
+  expires: 2030-04-01T00:00:00Z
+  features: [http]
+  labels:
+    team: web
+ci:
+  secrets:
+    - old-secret
+    - new-secret
+  disabled: true
+`
+
+func loadTestAccounts(t *testing.T, content string) *TokenSet {
+	path := filepath.Join(t.TempDir(), "account.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &TokenSet{Path: path}
+}
+
+func TestLoadAccounts(t *testing.T) {
+	ts := loadTestAccounts(t, testAccountsYAML)
+	user1 := ts.Get("user1")
+	if user1 == nil || len(user1.Secrets) != 1 || user1.Secrets[0] != "b554d3617be92f7c2449d8465534b54c" {
+		t.Fatalf("flat format is not accepted: %+v", user1)
+	}
+	if !user1.Allows(FeatureTCP, true) || user1.Allows(FeatureTCP, false) {
+		t.Errorf("account without features should follow the default")
+	}
+	c := ts.Get("contractor")
+	if c == nil || c.Name != "Contractor" || c.Labels["team"] != "web" || len(c.Secrets) != 1 {
+		t.Fatalf("unexpected account: %+v", c)
+	}
+	if !c.Expires.Equal(time.Date(2030, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expires is unexpected: %s", c.Expires)
+	}
+	if !c.Allows(FeatureHTTP, false) || c.Allows(FeatureTCP, true) {
+		t.Errorf("features are not applied")
+	}
+	if err := c.usable(time.Date(2030, 4, 1, 0, 0, 0, 0, time.UTC)); err != ErrAccountExpired {
+		t.Errorf("expired account is usable: %v", err)
+	}
+	ci := ts.Get("ci")
+	if ci == nil || len(ci.Secrets) != 2 || ci.usable(time.Now()) != ErrAccountDisabled {
+		t.Errorf("unexpected account: %+v", ci)
+	}
+}
+
+func TestLoadAccountsInvalid(t *testing.T) {
+	for _, content := range []string{
+		"user1:\n  name: no secret\n",
+		"user1:\n  secret: s\n  features: [ftp]\n",
+		"user1:\n",
+		"user1:\n  keys:\n    - secret: s\n",
+		"user1:\n  secret: s\n  allow-ip: [10.0.0.1]\n",
+		"user1:\n  keys:\n    - {version: v1, secret: a}\n    - {version: v1, secret: b}\n",
+		"user1:\n  keys:\n    - {version: v1, secret: a, not-before: 2030-01-01T00:00:00Z, not-after: 2029-01-01T00:00:00Z}\n",
+	} {
+		ts := loadTestAccounts(t, content)
+		if ts.Get("user1") != nil {
+			t.Errorf("invalid file is accepted: %q", content)
+		}
+	}
+}
+
+func TestValidateTokenAccountState(t *testing.T) {
+	ts := &TokenSet{Accounts: map[string]*Account{
+		"rotating": {Secrets: []string{"old", "new"}},
+		"disabled": {Secrets: []string{"s"}, Disabled: true},
+		"expired":  {Secrets: []string{"s"}, Expires: time.Now().Add(-time.Minute)},
+	}}
+	for _, c := range []struct {
+		keyID  string
+		secret string
+		err    error
+	}{
+		{"rotating", "old", nil},
+		{"rotating", "new", nil},
+		{"disabled", "s", ErrAccountDisabled},
+		{"expired", "s", ErrAccountExpired},
+	} {
+		token, err := GenerateToken(time.Now(), []byte(c.secret), c.keyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := validateToken(token, ts)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s/%s: %v", c.keyID, c.secret, err)
+		}
+		if err == nil && claims.account != ts.Accounts[c.keyID] {
+			t.Errorf("%s: account is not set", c.keyID)
+		}
+	}
+}
+
+func TestValidateTokenKeyRotation(t *testing.T) {
+	now := time.Now()
+	ts := &TokenSet{Accounts: map[string]*Account{
+		"user1": {Keys: []AccountKey{
+			{Version: "v1", Secret: "old", NotAfter: now.Add(time.Hour)},
+			{Version: "v2", Secret: "new", NotBefore: now.Add(-time.Hour)},
+			{Version: "v3", Secret: "next", NotBefore: now.Add(time.Hour)},
+			{Version: "v0", Secret: "retired", NotAfter: now.Add(-time.Hour)},
+		}},
+	}}
+	for _, c := range []struct {
+		secret  string
+		version string
+		err     error
+	}{
+		{"old", "v1", nil},
+		{"new", "v2", nil},
+		{"old", "", nil},
+		{"new", "", nil},
+		{"next", "v3", ErrKeyNotYetValid},
+		{"next", "", jwt.ErrTokenSignatureInvalid},
+		{"retired", "v0", ErrKeyExpired},
+		{"retired", "", jwt.ErrTokenSignatureInvalid},
+		{"old", "v2", jwt.ErrTokenSignatureInvalid},
+		{"old", "v9", ErrKeyVersionNotFound},
+	} {
+		token, err := GenerateToken(now, []byte(c.secret), "user1", WithKeyVersion(c.version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := validateToken(token, ts); !errors.Is(err, c.err) {
+			t.Errorf("%s/%s: %v", c.secret, c.version, err)
+		}
+	}
+
+	a := ts.Accounts["user1"]
+	if got := a.keyExpires("v1"); !got.Equal(now.Add(time.Hour)) {
+		t.Errorf("keyExpires(v1) = %s", got)
+	}
+	if got := a.keyExpires("v2"); !got.IsZero() {
+		t.Errorf("keyExpires(v2) = %s", got)
+	}
+	a.Expires = now.Add(time.Minute)
+	claims := &proxyClaims{KeyVersion: "v1", account: a}
+	if got := claims.responseHeader().Get("X-Kish-Key-Expires"); got != a.Expires.UTC().Format(time.RFC3339) {
+		t.Errorf("X-Kish-Key-Expires = %q", got)
+	}
+}
+
+func TestAuthenticateRemoteIP(t *testing.T) {
+	rs := &KishServer{
+		Host:     "kish.example.com",
+		TrustXFF: true,
+		KeyStore: &TokenSet{Accounts: map[string]*Account{
+			"office": {Secrets: []string{"s"}, AllowIP: []string{"10.0.0.0/8", "2001:db8::/32"}},
+			"anyone": {Secrets: []string{"s"}},
+		}},
+		ReplayCache: &ReplayCache{},
+	}
+	for _, c := range []struct {
+		keyID      string
+		remoteAddr string
+		xff        string
+		err        error
+	}{
+		{"office", "10.1.2.3:1234", "", nil},
+		{"office", "[2001:db8::1]:1234", "", nil},
+		{"office", "192.0.2.1:1234", "", ErrRemoteIPNotAllowed},
+		{"office", "127.0.0.1:1234", "10.1.2.3", nil},
+		{"office", "10.1.2.3:1234", "192.0.2.1", ErrRemoteIPNotAllowed},
+		{"anyone", "192.0.2.1:1234", "", nil},
+	} {
+		token, _ := GenerateToken(time.Now(), []byte("s"), c.keyID, WithAudience("kish.example.com"))
+		r := httptest.NewRequest(http.MethodGet, "/proxy2", nil)
+		r.RemoteAddr = c.remoteAddr
+		r.Header.Set("Authorization", "Bearer "+token)
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if _, err := rs.authenticate(r); !errors.Is(err, c.err) {
+			t.Errorf("%s from %s (%s): %v", c.keyID, c.remoteAddr, c.xff, err)
+		}
+	}
+}
+
+func TestAllowFeature(t *testing.T) {
+	rs := &KishServer{EnableTCPForwarding: false}
+	legacy := &proxyClaims{account: &Account{Secrets: []string{"s"}}}
+	tcpOnly := &proxyClaims{account: &Account{Secrets: []string{"s"}, Features: []string{FeatureTCP}}}
+	for _, c := range []struct {
+		claims  *proxyClaims
+		feature string
+		ok      bool
+	}{
+		{legacy, FeatureHTTP, true},
+		{legacy, FeatureCustomHost, true},
+		{legacy, FeatureTCP, false},
+		{tcpOnly, FeatureTCP, true},
+		{tcpOnly, FeatureHTTP, false},
+		{tcpOnly, FeatureCustomHost, false},
+	} {
+		rec := httptest.NewRecorder()
+		if ok := rs.allowFeature(rec, c.claims, c.feature); ok != c.ok || (!ok && rec.Code != http.StatusBadRequest) {
+			t.Errorf("%v %s: %v %d", c.claims.account.Features, c.feature, ok, rec.Code)
+		}
+	}
+}
+
+func TestTokenSetKeepsLastGoodSnapshot(t *testing.T) {
+	ts := loadTestAccounts(t, "user1: secret1\n")
+	ts.CheckInterval = time.Nanosecond
+	if err := ts.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ts.Path, []byte("user1: [broken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// 同じ時刻に書き換えてもサイズで気付く
+	if a := ts.Get("user1"); a == nil || a.Secrets[0] != "secret1" {
+		t.Errorf("last good snapshot is dropped: %+v", a)
+	}
+	status := ts.Status()
+	if status.LoadErrors != 1 || status.LastError == nil || status.Accounts != 1 {
+		t.Errorf("status is unexpected: %+v", status)
+	}
+	// 壊れたままなら読み直さない
+	ts.Get("user1")
+	if ts.Status().LoadErrors != 1 {
+		t.Errorf("broken file is loaded again")
+	}
+	rec := httptest.NewRecorder()
+	(&KishServer{KeyStore: ts}).StatusHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "kish_accounts_load_errors_total 1\n") || !strings.Contains(body, "kish_accounts_loaded 1\n") {
+		t.Errorf("metrics: %s", body)
+	}
+	if err := os.WriteFile(ts.Path, []byte("user1: secret2\nuser2: secret3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if a := ts.Get("user1"); a == nil || a.Secrets[0] != "secret2" {
+		t.Errorf("fixed file is not loaded: %+v", a)
+	}
+	if m := ts.Current(); len(m) != 2 || m["user2"] == nil {
+		t.Errorf("Current: %+v", m)
+	}
+}
+
+func TestTokenSetThrottle(t *testing.T) {
+	ts := loadTestAccounts(t, "user1: secret1\n")
+	ts.CheckInterval = time.Hour
+	if ts.Get("user1") == nil {
+		t.Fatal("not loaded")
+	}
+	if err := os.WriteFile(ts.Path, []byte("user2: secret2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ts.Get("user1") == nil || ts.Get("user2") != nil {
+		t.Errorf("file is checked before the interval")
+	}
+}
+
+func TestTokenSetConcurrentGet(t *testing.T) {
+	ts := loadTestAccounts(t, "user1: secret1\n")
+	ts.CheckInterval = time.Nanosecond
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 50 {
+			os.WriteFile(ts.Path, []byte(fmt.Sprintf("user1: secret%d\n", i)), 0600)
+		}
+	}()
+	for range 1000 {
+		if ts.Get("user1") == nil {
+			t.Fatal("account disappeared while reloading")
+		}
+	}
+	<-done
+}
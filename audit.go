@@ -0,0 +1,274 @@
+package kish
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AuditAuthSuccess = "auth-success"
+	AuditAuthFailure = "auth-failure"
+	AuditTunnelOpen  = "tunnel-open"
+	AuditTunnelClose = "tunnel-close"
+	AuditLockout     = "lockout"
+	AuditAdmin       = "admin"
+)
+
+const (
+	defaultAuditMaxSize    = 100 << 20
+	defaultAuditMaxBackups = 5
+)
+
+// 監査ログの1行。秘密鍵やパスワードは含めない
+type AuditEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	KeyID string    `json:"keyID,omitempty"`
+	// 委任トークンで認証した場合はそのID
+	Delegation string `json:"delegation,omitempty"`
+	// トンネルを張ったクライアント、ロックアウトでは訪問者
+	RemoteIP string `json:"remoteIP,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	// http, tcp, tls, udp, private, connect
+	Type string `json:"type,omitempty"`
+	Host string `json:"host,omitempty"`
+	// TCP, UDPで開いたポート
+	Addr   string           `json:"addr,omitempty"`
+	Reason string           `json:"reason,omitempty"`
+	Params *AuditParameters `json:"params,omitempty"`
+	// トンネルを張っていた時間、ロックアウトではロックした時間(秒)
+	Duration float64 `json:"duration,omitempty"`
+	// クライアントから受け取った量と送った量
+	BytesIn  int64 `json:"bytesIn,omitempty"`
+	BytesOut int64 `json:"bytesOut,omitempty"`
+	// 以下はkish-server accountなどの管理操作
+	Action   string `json:"action,omitempty"`
+	Operator string `json:"operator,omitempty"`
+}
+
+// ProxyParametersのうち記録してよいもの
+type AuditParameters struct {
+	AllowIP       []string `json:"allowIP,omitempty"`
+	AllowMyIP     bool     `json:"allowMyIP,omitempty"`
+	Users         []string `json:"users,omitempty"`
+	LoginForm     bool     `json:"loginForm,omitempty"`
+	APIKeys       int      `json:"apiKeys,omitempty"`
+	TokenAuth     int      `json:"tokenAuth,omitempty"`
+	JWT           bool     `json:"jwt,omitempty"`
+	ClientCert    bool     `json:"clientCert,omitempty"`
+	OIDC          bool     `json:"oidc,omitempty"`
+	Private       string   `json:"private,omitempty"`
+	AllowAccounts []string `json:"allowAccounts,omitempty"`
+}
+
+func auditParameters(params *ProxyParameters) *AuditParameters {
+	if params == nil {
+		return nil
+	}
+	ap := &AuditParameters{
+		AllowIP:       params.AllowIP,
+		AllowMyIP:     params.AllowMyIP,
+		LoginForm:     params.LoginForm,
+		APIKeys:       len(params.APIKeys),
+		TokenAuth:     len(params.TokenAuth),
+		JWT:           params.JWT != nil,
+		ClientCert:    params.ClientCA != "",
+		OIDC:          params.OIDC != nil,
+		Private:       params.Private,
+		AllowAccounts: params.AllowAccounts,
+	}
+	for user := range params.BasicAuth {
+		ap.Users = append(ap.Users, user)
+	}
+	slices.Sort(ap.Users)
+	return ap
+}
+
+// JSON Linesで追記する。MaxSizeを超えるとPath.1, Path.2, ...にずらす
+type AuditLog struct {
+	Path string
+	// 0ならデフォルト値
+	MaxSize    int64
+	MaxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// nilなら何もしない。書けなくてもトンネルは止めずにログに出す
+func (l *AuditLog) Write(ev AuditEvent) {
+	if l == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("AuditLog: failed to marshal", "err", err)
+		return
+	}
+	l.writeLine(b)
+}
+
+// アクセスログもローテーションは同じしくみを使う
+func (l *AuditLog) writeLine(b []byte) {
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Closeの後に書こうとしても開き直さない
+	if l.closed {
+		return
+	}
+	if err := l.write(b); err != nil {
+		slog.Error("AuditLog: failed to write", "path", l.Path, "err", err)
+	}
+}
+
+// muを取ってから呼ぶこと
+func (l *AuditLog) write(b []byte) error {
+	maxSize := l.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultAuditMaxSize
+	}
+	if l.f != nil && l.size > 0 && l.size+int64(len(b)) > maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if l.f == nil {
+		f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		l.f, l.size = f, stat.Size()
+		// 開いた時点で既に大きければ先にずらす
+		if l.size > 0 && l.size+int64(len(b)) > maxSize {
+			return l.write(b)
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+func (l *AuditLog) rotate() error {
+	l.f.Close()
+	l.f = nil
+	backups := l.MaxBackups
+	if backups == 0 {
+		backups = defaultAuditMaxBackups
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.Path, backups))
+	for i := backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.Path, i), fmt.Sprintf("%s.%d", l.Path, i+1))
+	}
+	return os.Rename(l.Path, l.Path+".1")
+}
+
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// トンネルの通信量を数える
+type countingRWC struct {
+	io.ReadWriteCloser
+	in, out atomic.Int64
+}
+
+func newCountingRWC(rwc io.ReadWriteCloser) *countingRWC {
+	return &countingRWC{ReadWriteCloser: rwc}
+}
+
+func (c *countingRWC) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *countingRWC) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+func (c *proxyClaims) delegationID() string {
+	if c.delegation == nil {
+		return ""
+	}
+	return c.delegation.ID
+}
+
+func (rs *KishServer) auditAuth(r *http.Request, token string, claims *proxyClaims, err error) {
+	if rs.AuditLog == nil {
+		return
+	}
+	ev := AuditEvent{
+		Event:    AuditAuthSuccess,
+		RemoteIP: GetRemoteIP(r, rs.TrustXFF),
+		Endpoint: r.URL.Path,
+	}
+	if err != nil {
+		ev.Event = AuditAuthFailure
+		ev.Reason = err.Error()
+		// 検証できなかったトークンのkeyIDは参考程度
+		var unverified proxyClaims
+		if _, _, err := jwt.NewParser().ParseUnverified(token, &unverified); err == nil {
+			ev.KeyID = unverified.KeyID
+		}
+	} else {
+		ev.KeyID = claims.KeyID
+		ev.Delegation = claims.delegationID()
+	}
+	rs.AuditLog.Write(ev)
+}
+
+// トンネルを張ったことを記録し、閉じたときに記録する関数を返す。deferで呼ぶ
+func (rs *KishServer) auditTunnel(r *http.Request, claims *proxyClaims, params *ProxyParameters, ev AuditEvent, rwc *countingRWC) func() {
+	if rs.AuditLog == nil {
+		return func() {}
+	}
+	ev.Event = AuditTunnelOpen
+	ev.KeyID = claims.KeyID
+	ev.Delegation = claims.delegationID()
+	ev.RemoteIP = GetRemoteIP(r, rs.TrustXFF)
+	ev.Params = auditParameters(params)
+	start := time.Now()
+	rs.AuditLog.Write(ev)
+	return func() {
+		ev.Event = AuditTunnelClose
+		ev.Duration = time.Since(start).Seconds()
+		if rwc != nil {
+			ev.BytesIn, ev.BytesOut = rwc.in.Load(), rwc.out.Load()
+		}
+		rs.AuditLog.Write(ev)
+	}
+}
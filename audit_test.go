@@ -0,0 +1,149 @@
+package kish
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAuditLog(t *testing.T, path string) []AuditEvent {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []AuditEvent
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var ev AuditEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("%s: %q", err, sc.Text())
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := &AuditLog{Path: path, MaxSize: 300, MaxBackups: 2}
+	defer l.Close()
+	for i := 0; i < 20; i++ {
+		l.Write(AuditEvent{Event: AuditAdmin, Action: "test", KeyID: strings.Repeat("x", i)})
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		stat, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() > 300 {
+			t.Errorf("%s is too large: %d", p, stat.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("too many backups")
+	}
+	events := readAuditLog(t, path)
+	if last := events[len(events)-1]; last.KeyID != strings.Repeat("x", 19) || last.Time.IsZero() {
+		t.Errorf("unexpected: %+v", last)
+	}
+
+	// 既に大きいファイルを開いた場合
+	l2 := &AuditLog{Path: path, MaxSize: 300, MaxBackups: 2}
+	defer l2.Close()
+	os.WriteFile(path, bytes.Repeat([]byte("{}\n"), 100), 0600)
+	l2.Write(AuditEvent{Event: AuditAdmin})
+	if events := readAuditLog(t, path); len(events) != 1 {
+		t.Errorf("large file is not rotated: %d events", len(events))
+	}
+
+	var nilLog *AuditLog
+	nilLog.Write(AuditEvent{Event: AuditAdmin})
+}
+
+func TestAuditParametersHideSecrets(t *testing.T) {
+	params := &ProxyParameters{
+		AllowIP:   []string{"192.0.2.0/24"},
+		BasicAuth: map[string]string{"bob": "bob-password", "alice": "alice-password"},
+		APIKeys:   []string{"api-key-value"},
+		TokenAuth: []TokenAuth{{Header: "X-Token", Value: "token-value"}},
+		ClientCA:  "-----BEGIN CERTIFICATE-----",
+	}
+	b, _ := json.Marshal(auditParameters(params))
+	for _, secret := range []string{"password", "api-key-value", "token-value", "CERTIFICATE"} {
+		if bytes.Contains(b, []byte(secret)) {
+			t.Errorf("%s is in the audit log: %s", secret, b)
+		}
+	}
+	ap := auditParameters(params)
+	if strings.Join(ap.Users, ",") != "alice,bob" || ap.APIKeys != 1 || ap.TokenAuth != 1 || !ap.ClientCert {
+		t.Errorf("unexpected: %+v", ap)
+	}
+}
+
+func TestAuditAuthAndTunnel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rs := &KishServer{
+		Host:        "kish.example.com",
+		KeyStore:    &TokenSet{Accounts: map[string]*Account{"user1": {Secrets: []string{"s"}}}},
+		ReplayCache: &ReplayCache{},
+		AuditLog:    &AuditLog{Path: path},
+	}
+	defer rs.AuditLog.Close()
+	request := func(secret string) *http.Request {
+		token, _ := GenerateToken(time.Now(), []byte(secret), "user1", WithAudience("kish.example.com"))
+		r := httptest.NewRequest(http.MethodGet, "/proxy2", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	if _, err := rs.authenticate(request("wrong")); err == nil {
+		t.Fatal("wrong secret is accepted")
+	}
+	r := request("s")
+	claims, err := rs.authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	rwc := newCountingRWC(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{strings.NewReader("hello"), &buf, io.NopCloser(nil)})
+	done := rs.auditTunnel(r, claims, &ProxyParameters{AllowIP: []string{"192.0.2.0/24"}}, AuditEvent{Type: FeatureHTTP, Host: "a.kish.example.com"}, rwc)
+	io.ReadAll(rwc)
+	rwc.Write([]byte("world!"))
+	done()
+
+	p := &proxy2Struct{host: "a.kish.example.com", limiter: newAuthLimiter(), events: newEventSink(), keyID: "user1", audit: rs.AuditLog}
+	for range defaultLockoutThreshold {
+		p.recordAuthFailure("198.51.100.1")
+	}
+
+	events := readAuditLog(t, path)
+	var kinds []string
+	for _, ev := range events {
+		kinds = append(kinds, ev.Event)
+	}
+	if got := strings.Join(kinds, " "); got != "auth-failure auth-success tunnel-open tunnel-close lockout" {
+		t.Fatalf("unexpected events: %s", got)
+	}
+	if ev := events[0]; ev.KeyID != "user1" || ev.Reason == "" || ev.RemoteIP != "192.0.2.1" || ev.Endpoint != "/proxy2" {
+		t.Errorf("auth-failure: %+v", ev)
+	}
+	if ev := events[3]; ev.BytesIn != 5 || ev.BytesOut != 6 || ev.Host != "a.kish.example.com" || ev.Params == nil || ev.Duration <= 0 {
+		t.Errorf("tunnel-close: %+v", ev)
+	}
+	if ev := events[4]; ev.RemoteIP != "198.51.100.1" || ev.KeyID != "user1" || ev.Duration != defaultLockoutBase.Seconds() {
+		t.Errorf("lockout: %+v", ev)
+	}
+}
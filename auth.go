@@ -1,6 +1,9 @@
 package kish
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
 	"time"
 
@@ -13,11 +16,23 @@ var (
 	ErrLifetimeTooLong          = errors.New("lifetime is too long")
 	ErrKeyNotFound              = errors.New("key not found")
 	ErrInvalidToken             = errors.New("invalid token")
+	ErrKeyTypeMismatch          = errors.New("signing method does not match the key type")
+	ErrParametersMismatch       = errors.New("parameters do not match the token")
+	ErrParametersNotSigned      = errors.New("parameters are not signed")
 )
 
 type proxyClaims struct {
 	KeyID string `json:"keyID"`
+	// アカウントのKeysのどれで署名したか。省略するとSecretsと今有効なKeysのどれか
+	KeyVersion string `json:"keyVersion,omitempty"`
+	// X-Kish-HTTPヘッダーの値のSHA-256
+	ParamsHash string `json:"paramsHash,omitempty"`
+	// 委任トークン。あればKeyIDのアカウントの鍵ではなく委任トークンの公開鍵で署名する
+	Delegation string `json:"delegation,omitempty"`
 	jwt.RegisteredClaims
+	// 検証に使ったアカウント
+	account    *Account
+	delegation *DelegationClaims
 }
 
 func (c *proxyClaims) GetKeyID() string {
@@ -34,34 +49,124 @@ func (c *proxyClaims) Validate() error {
 	return nil
 }
 
-func validateToken(t string, ts *TokenSet) error {
+func validateToken(t string, ks KeyStore, opts ...jwt.ParserOption) (*proxyClaims, error) {
+	var account *Account
 	keyfunc := func(token *jwt.Token) (interface{}, error) {
 		keyID := token.Claims.(HasKeyID).GetKeyID()
-		key := ts.Get(keyID)
-		if key == nil {
+		var err error
+		account, err = ks.Lookup(keyID)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil {
 			return nil, ErrKeyNotFound
 		}
-		return key, nil
+		if err := account.usable(time.Now()); err != nil {
+			return nil, err
+		}
+		if c := token.Claims.(*proxyClaims); c.Delegation != "" {
+			dc, pub, err := verifyDelegation(c.Delegation, keyID, account, time.Now(), opts...)
+			if err != nil {
+				return nil, err
+			}
+			if !methodMatchesKey(token.Method, pub) {
+				return nil, ErrKeyTypeMismatch
+			}
+			c.delegation = dc
+			return pub, nil
+		}
+		keys, err := account.keys(keyID, token.Claims.(*proxyClaims).KeyVersion, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		var set jwt.VerificationKeySet
+		for _, key := range keys {
+			if methodMatchesKey(token.Method, key) {
+				set.Keys = append(set.Keys, key)
+			}
+		}
+		if len(set.Keys) == 0 {
+			return nil, ErrKeyTypeMismatch
+		}
+		return set, nil
 	}
 	claims := proxyClaims{}
-	token, err := jwt.ParseWithClaims(t, &claims, keyfunc)
+	token, err := jwt.ParseWithClaims(t, &claims, keyfunc, opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !token.Valid {
-		return ErrInvalidToken
+		return nil, ErrInvalidToken
+	}
+	claims.account = account
+	return &claims, nil
+}
+
+type TokenOption func(*proxyClaims)
+
+// トークンを特定のkish-server向けに限定する。サーバー側はKishServer.Hostと比較する
+func WithAudience(aud string) TokenOption {
+	return func(c *proxyClaims) {
+		c.Audience = jwt.ClaimStrings{aud}
+	}
+}
+
+// アカウントのKeysのうちどれで署名したかを示す
+func WithKeyVersion(version string) TokenOption {
+	return func(c *proxyClaims) {
+		c.KeyVersion = version
+	}
+}
+
+// 委任トークンを使う。keyは委任トークンと一緒に渡された秘密鍵
+func WithDelegation(token string) TokenOption {
+	return func(c *proxyClaims) {
+		c.Delegation = token
+	}
+}
+
+// X-Kish-HTTPヘッダーで送るパラメータを署名の対象に含める
+func WithParameters(param string) TokenOption {
+	return func(c *proxyClaims) {
+		c.ParamsHash = hashParameters(param)
+	}
+}
+
+func hashParameters(param string) string {
+	sum := sha256.Sum256([]byte(param))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// トークンにハッシュがあればパラメータと一致することを確認する
+func (c *proxyClaims) verifyParameters(param string, required bool) error {
+	if c.ParamsHash == "" {
+		if required {
+			return ErrParametersNotSigned
+		}
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(c.ParamsHash), []byte(hashParameters(param))) != 1 {
+		return ErrParametersMismatch
 	}
 	return nil
 }
 
-func GenerateToken(now time.Time, key []byte, keyID string) (string, error) {
+// keyは共有秘密鍵なら[]byte、そうでなければcrypto.Signerの秘密鍵
+func GenerateToken(now time.Time, key interface{}, keyID string, opts ...TokenOption) (string, error) {
+	method, err := signingMethodForKey(key)
+	if err != nil {
+		return "", err
+	}
 	claims := proxyClaims{
-		keyID,
-		jwt.RegisteredClaims{
+		KeyID: keyID,
+		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(now.Add(300 * time.Second)),
 			NotBefore: jwt.NewNumericDate(now.Add(-300 * time.Second)),
 			ID:        uuid.New().String(),
 		},
 	}
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	for _, opt := range opts {
+		opt(&claims)
+	}
+	return jwt.NewWithClaims(method, claims).SignedString(key)
 }
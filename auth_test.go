@@ -1,6 +1,7 @@
 package kish
 
 import (
+	"crypto"
 	"errors"
 	"testing"
 	"time"
@@ -53,15 +54,15 @@ func TestValidateToken(t *testing.T) {
 	keyValue := "abc"
 	keyID := "z"
 	ts := TokenSet{
-		Tokens: &map[string]string{
-			keyID: keyValue,
+		Accounts: map[string]*Account{
+			keyID: {Secrets: []string{keyValue}},
 		},
 	}
 	tokenStr, err1 := GenerateToken(time.Now(), []byte(keyValue), keyID)
 	if err1 != nil {
 		t.Errorf("err1: %+v", err1)
 	}
-	err2 := validateToken(tokenStr, &ts)
+	_, err2 := validateToken(tokenStr, &ts)
 	if err2 != nil {
 		t.Errorf("err2: %+v", err2)
 	}
@@ -72,15 +73,15 @@ func TestValidateTokenKeyIDBad(t *testing.T) {
 	keyID := "z"
 	keyIDBad := "zbad"
 	ts := TokenSet{
-		Tokens: &map[string]string{
-			keyID: keyValue,
+		Accounts: map[string]*Account{
+			keyID: {Secrets: []string{keyValue}},
 		},
 	}
 	tokenStr, err1 := GenerateToken(time.Now(), []byte(keyValue), keyIDBad)
 	if err1 != nil {
 		t.Errorf("err1: %+v", err1)
 	}
-	err2 := validateToken(tokenStr, &ts)
+	_, err2 := validateToken(tokenStr, &ts)
 	if !errors.Is(err2, jwt.ErrTokenUnverifiable) {
 		t.Errorf("err2 is unexpected: %+v", err2)
 	}
@@ -91,16 +92,133 @@ func TestValidateTokenKeyValueBad(t *testing.T) {
 	keyValueBad := "bad"
 	keyID := "z"
 	ts := TokenSet{
-		Tokens: &map[string]string{
-			keyID: keyValue,
+		Accounts: map[string]*Account{
+			keyID: {Secrets: []string{keyValue}},
 		},
 	}
 	tokenStr, err1 := GenerateToken(time.Now(), []byte(keyValueBad), keyID)
 	if err1 != nil {
 		t.Errorf("err1: %+v", err1)
 	}
-	err2 := validateToken(tokenStr, &ts)
+	_, err2 := validateToken(tokenStr, &ts)
 	if !errors.Is(err2, jwt.ErrSignatureInvalid) {
 		t.Errorf("err2 is unexpected: %+v", err2)
 	}
 }
+
+func TestValidateTokenPublicKey(t *testing.T) {
+	for _, keyType := range []string{"ed25519", "ecdsa", "rsa"} {
+		t.Run(keyType, func(t *testing.T) {
+			priv, err := GeneratePrivateKey(keyType)
+			if err != nil {
+				t.Fatalf("GeneratePrivateKey: %+v", err)
+			}
+			pub, err := MarshalPublicKeyString(priv.Public())
+			if err != nil {
+				t.Fatalf("MarshalPublicKeyString: %+v", err)
+			}
+			ts := TokenSet{
+				Accounts: map[string]*Account{
+					"z": {Secrets: []string{pub}},
+				},
+			}
+			tokenStr, err1 := GenerateToken(time.Now(), priv, "z")
+			if err1 != nil {
+				t.Errorf("err1: %+v", err1)
+			}
+			_, err2 := validateToken(tokenStr, &ts)
+			if err2 != nil {
+				t.Errorf("err2: %+v", err2)
+			}
+		})
+	}
+}
+
+func TestValidateTokenPublicKeyAsHMACSecret(t *testing.T) {
+	priv, err := GeneratePrivateKey("ed25519")
+	if err != nil {
+		t.Fatalf("GeneratePrivateKey: %+v", err)
+	}
+	pub, err := MarshalPublicKeyString(priv.Public())
+	if err != nil {
+		t.Fatalf("MarshalPublicKeyString: %+v", err)
+	}
+	ts := TokenSet{
+		Accounts: map[string]*Account{
+			"z": {Secrets: []string{pub}},
+		},
+	}
+	// 公開鍵は秘密ではないので、それをHMACの鍵にしたトークンは通してはいけない
+	tokenStr, err1 := GenerateToken(time.Now(), []byte(pub), "z")
+	if err1 != nil {
+		t.Errorf("err1: %+v", err1)
+	}
+	_, err2 := validateToken(tokenStr, &ts)
+	if !errors.Is(err2, ErrKeyTypeMismatch) {
+		t.Errorf("err2 is unexpected: %+v", err2)
+	}
+}
+
+func TestPrivateKeyPEMRoundTrip(t *testing.T) {
+	priv, err := GeneratePrivateKey("ecdsa")
+	if err != nil {
+		t.Fatalf("GeneratePrivateKey: %+v", err)
+	}
+	b, err := MarshalPrivateKeyPEM(priv)
+	if err != nil {
+		t.Fatalf("MarshalPrivateKeyPEM: %+v", err)
+	}
+	parsed, err := ParsePrivateKeyPEM(b)
+	if err != nil {
+		t.Fatalf("ParsePrivateKeyPEM: %+v", err)
+	}
+	if !priv.(interface{ Equal(crypto.PrivateKey) bool }).Equal(parsed) {
+		t.Errorf("parsed key differs")
+	}
+}
+
+func TestValidateTokenAudience(t *testing.T) {
+	ts := TokenSet{
+		Accounts: map[string]*Account{
+			"z": {Secrets: []string{"abc"}},
+		},
+	}
+	tokenStr, err1 := GenerateToken(time.Now(), []byte("abc"), "z", WithAudience("kish.example.com"))
+	if err1 != nil {
+		t.Errorf("err1: %+v", err1)
+	}
+	_, err2 := validateToken(tokenStr, &ts, jwt.WithAudience("kish.example.com"))
+	if err2 != nil {
+		t.Errorf("err2: %+v", err2)
+	}
+	_, err3 := validateToken(tokenStr, &ts, jwt.WithAudience("other.example.com"))
+	if !errors.Is(err3, jwt.ErrTokenInvalidAudience) {
+		t.Errorf("err3 is unexpected: %+v", err3)
+	}
+}
+
+func TestProxyClaimsVerifyParameters(t *testing.T) {
+	signed := proxyClaims{}
+	WithParameters("eyJob3N0IjoiIn0=")(&signed)
+	unsigned := proxyClaims{}
+	p := []struct {
+		title    string
+		err      error
+		claims   *proxyClaims
+		param    string
+		required bool
+	}{
+		{"match", nil, &signed, "eyJob3N0IjoiIn0=", false},
+		{"modified", ErrParametersMismatch, &signed, "eyJob3N0IjoieCJ9", false},
+		{"unsigned", nil, &unsigned, "eyJob3N0IjoiIn0=", false},
+		{"unsigned but required", ErrParametersNotSigned, &unsigned, "eyJob3N0IjoiIn0=", true},
+	}
+	for _, i := range p {
+		t.Run(i.title, func(t *testing.T) {
+			err := i.claims.verifyParameters(i.param, i.required)
+			if !errors.Is(err, i.err) {
+				t.Errorf("err is unexpected: %+v", err)
+			}
+		})
+	}
+}
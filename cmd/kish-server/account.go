@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/no2a/kish"
+)
+
+func accountMain(command string) error {
+	path := *flag_accountFile
+	if path == "" {
+		path = config.TokenSetPath
+	}
+	if path == "" {
+		return errors.New("specify --file or --config with account")
+	}
+	f, err := kish.OpenAccountFile(path)
+	if err != nil {
+		return err
+	}
+	ev := kish.AuditEvent{Event: kish.AuditAdmin, Action: command, Operator: operator()}
+	switch command {
+	case "account add":
+		ev.KeyID = *flag_accountAddID
+		err = accountAdd(f)
+	case "account list":
+		return accountList(f)
+	case "account disable":
+		ev.KeyID = *flag_disableID
+		if *flag_disableUndo {
+			ev.Action = "account enable"
+		}
+		err = f.SetDisabled(*flag_disableID, !*flag_disableUndo)
+		if err == nil {
+			err = f.Save()
+		}
+	case "account rotate":
+		ev.KeyID = *flag_rotateID
+		err = accountRotate(f)
+	case "account revoke":
+		ev.KeyID, ev.Delegation = *flag_revokeID, *flag_revokeTokenID
+		err = f.RevokeDelegation(*flag_revokeID, *flag_revokeTokenID)
+		if err == nil {
+			err = f.Save()
+		}
+	case "account remove":
+		ev.KeyID = *flag_removeID
+		err = f.Remove(*flag_removeID)
+		if err == nil {
+			err = f.Save()
+		}
+	default:
+		return fmt.Errorf("unknown command %s", command)
+	}
+	// 失敗した操作も残す
+	if err != nil {
+		ev.Reason = err.Error()
+	}
+	al := auditLog()
+	al.Write(ev)
+	al.Close()
+	return err
+}
+
+// sudoで実行した場合は元のユーザー
+func operator() string {
+	if u := os.Getenv("SUDO_USER"); u != "" {
+		return u
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// 公開鍵が渡されればそれを、なければ新しい共有秘密鍵を返す
+func newSecret(pubkey string) (string, error) {
+	if pubkey == "" {
+		return kish.GenerateSecret()
+	}
+	if !strings.HasPrefix(pubkey, kish.PublicKeyPrefix) {
+		pubkey = kish.PublicKeyPrefix + pubkey
+	}
+	if _, err := kish.ParsePublicKeyString(pubkey); err != nil {
+		return "", fmt.Errorf("public key is invalid: %w", err)
+	}
+	return pubkey, nil
+}
+
+func parseExpires(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func printClientConfig(keyID string, secret string, version string) {
+	fmt.Printf("add these lines to the client config:\n\n")
+	if strings.HasPrefix(secret, kish.PublicKeyPrefix) {
+		fmt.Printf("key: %s\n", keyID)
+	} else {
+		fmt.Printf("key: %s/%s\n", keyID, secret)
+	}
+	if version != "" {
+		fmt.Printf("key-version: \"%s\"\n", version)
+	}
+}
+
+func accountAdd(f *kish.AccountFile) error {
+	keyID := *flag_accountAddID
+	secret, err := newSecret(*flag_accountPubkey)
+	if err != nil {
+		return err
+	}
+	a := &kish.Account{
+		Secrets:  []string{secret},
+		Name:     *flag_accountName,
+		Features: *flag_accountFeatures,
+	}
+	if len(*flag_accountAllowIP) > 0 {
+		a.AllowIP = *flag_accountAllowIP
+	}
+	if *flag_accountExpires != "" {
+		if a.Expires, err = parseExpires(*flag_accountExpires); err != nil {
+			return err
+		}
+	}
+	if err := f.Add(keyID, a); err != nil {
+		return err
+	}
+	if err := f.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("account %s has been added to %s\n\n", keyID, f.Path)
+	printClientConfig(keyID, secret, "")
+	return nil
+}
+
+func accountRotate(f *kish.AccountFile) error {
+	keyID := *flag_rotateID
+	secret, err := newSecret(*flag_rotatePubkey)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	version, err := f.Rotate(keyID, secret, now, *flag_rotateOverlap)
+	if err != nil {
+		return err
+	}
+	if err := f.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("new key of %s has been added to %s. the current keys can be used until %s\n\n", keyID, f.Path, now.Add(*flag_rotateOverlap).Format(time.DateTime))
+	printClientConfig(keyID, secret, version)
+	return nil
+}
+
+func accountList(f *kish.AccountFile) error {
+	keyIDs, accounts, err := f.Accounts()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY ID\tNAME\tSTATUS\tEXPIRES\tFEATURES\tKEYS")
+	for _, keyID := range keyIDs {
+		a := accounts[keyID]
+		if a == nil {
+			continue
+		}
+		status := "active"
+		if a.Disabled {
+			status = "disabled"
+		} else if !a.Expires.IsZero() && !now.Before(a.Expires) {
+			status = "expired"
+		}
+		expires := "-"
+		if !a.Expires.IsZero() {
+			expires = a.Expires.Local().Format(time.DateTime)
+		}
+		features := "(default)"
+		if a.Features != nil {
+			features = strings.Join(a.Features, ",")
+		}
+		keys := make([]string, 0, len(a.Secrets)+len(a.Keys))
+		for range a.Secrets {
+			keys = append(keys, "-")
+		}
+		for _, k := range a.Keys {
+			s := k.Version
+			if !k.NotAfter.IsZero() {
+				s += " until " + k.NotAfter.Local().Format(time.DateOnly)
+			}
+			keys = append(keys, s)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", keyID, a.Name, status, expires, features, strings.Join(keys, ", "))
+	}
+	return w.Flush()
+}
@@ -1,34 +1,142 @@
 package main
 
 import (
-	"log"
+	"encoding/base64"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/no2a/kish"
 	"gopkg.in/yaml.v3"
 )
 
+type OIDCConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client-id"`
+	ClientSecret string   `yaml:"client-secret"`
+	RedirectURL  string   `yaml:"redirect-url"`
+	Scopes       []string `yaml:"scopes"`
+	GroupsClaim  string   `yaml:"groups-claim"`
+	// base64で32バイト。省略すると再起動でログインし直しになる
+	CookieKey       string        `yaml:"cookie-key"`
+	SessionLifetime time.Duration `yaml:"session-lifetime"`
+}
+
+type AuditLogConfig struct {
+	Path string `yaml:"path"`
+	// 省略すると100MB, 5世代
+	MaxSizeMB  int64 `yaml:"max-size-mb"`
+	MaxBackups int   `yaml:"max-backups"`
+}
+
+type AccessLogConfig struct {
+	// HTTPトンネルごとに<dir>/<ホスト名>.logに書く
+	Dir string `yaml:"dir"`
+	// combinedかjson
+	Format     string `yaml:"format"`
+	MaxSizeMB  int64  `yaml:"max-size-mb"`
+	MaxBackups int    `yaml:"max-backups"`
+	// これより長く更新されていないファイルは消す。省略すると30日
+	MaxAge time.Duration `yaml:"max-age"`
+}
+
 type ServerConfig struct {
-	Host                string `yaml:"host"`
-	DomainSuffix        string `yaml:"domain-suffix"`
-	ListenAddr          string `yaml:"listen"`
-	TrustXFF            bool   `yaml:"trust-x-forwarded-for"`
-	TokenSetPath        string `yaml:"account"`
-	TLSCert             string `yaml:"tls-cert"`
-	TLSKey              string `yaml:"tls-key"`
-	EnableTCPForwarding bool   `yaml:"enable-tcp-forwarding"`
+	Host         string `yaml:"host"`
+	DomainSuffix string `yaml:"domain-suffix"`
+	ListenAddr   string `yaml:"listen"`
+	TrustXFF     bool   `yaml:"trust-x-forwarded-for"`
+	TokenSetPath string `yaml:"account"`
+	// accountの代わりに使える。どれか1つだけを指定する
+	AccountDir          string           `yaml:"account-dir"`
+	AccountEnvPrefix    string           `yaml:"account-env-prefix"`
+	AccountURL          string           `yaml:"account-url"`
+	AccountURLToken     string           `yaml:"account-url-token"`
+	TLSCert             string           `yaml:"tls-cert"`
+	TLSKey              string           `yaml:"tls-key"`
+	EnableTCPForwarding bool             `yaml:"enable-tcp-forwarding"`
+	EnableUDPForwarding bool             `yaml:"enable-udp-forwarding"`
+	ReplayCacheFile     string           `yaml:"replay-cache-file"`
+	ReplayCacheSize     int              `yaml:"replay-cache-size"`
+	RequireSignedParams bool             `yaml:"require-signed-parameters"`
+	OIDC                *OIDCConfig      `yaml:"oidc"`
+	RequestClientCert   bool             `yaml:"request-client-cert"`
+	AuditLog            *AuditLogConfig  `yaml:"audit-log"`
+	AccessLog           *AccessLogConfig `yaml:"access-log"`
+	// クライアントがjwks-urlに指定できるURL。/で終わればその下全部
+	AllowJWKSURLs []string `yaml:"allow-jwks-urls"`
+	// 指定するとアカウントファイルの読み込み状況などを/metricsで返す。127.0.0.1:9100のように外から見えないアドレスにする
+	StatusListen string `yaml:"status-listen"`
+	// debug, info, warn, error
+	LogLevel string `yaml:"log-level"`
+	// textかjson
+	LogFormat string `yaml:"log-format"`
 }
 
 var (
+	flag_configFile *string
+	flag_logLevel   *string
+	flag_logFormat  *string
+
+	flag_accountFile     *string
+	flag_accountAddID    *string
+	flag_accountName     *string
+	flag_accountExpires  *string
+	flag_accountFeatures *[]string
+	flag_accountPubkey   *string
+	flag_accountAllowIP  *[]string
+	flag_disableID       *string
+	flag_disableUndo     *bool
+	flag_rotateID        *string
+	flag_rotateOverlap   *time.Duration
+	flag_rotatePubkey    *string
+	flag_removeID        *string
+	flag_revokeID        *string
+	flag_revokeTokenID   *string
+
 	config ServerConfig
 )
 
 func parse() string {
-	p := kingpin.Flag("config", "config file").Required().ExistingFile()
-	kingpin.Parse()
-	return *p
+	app := kingpin.New("kish-server", "")
+	flag_configFile = app.Flag("config", "config file").ExistingFile()
+	flag_logLevel = app.Flag("log-level", "debug, info, warn or error (default to log-level in the config file)").String()
+	flag_logFormat = app.Flag("log-format", "text or json (default to log-format in the config file)").String()
+
+	app.Command("serve", "run the server").Default()
+
+	account := app.Command("account", "edit the account file")
+	flag_accountFile = account.Flag("file", "account file (default to account in the config file)").String()
+
+	add := account.Command("add", "add an account with a new secret")
+	flag_accountName = add.Flag("name", "").String()
+	flag_accountExpires = add.Flag("expires", "date (2006-01-02) or RFC 3339 time after which the account cannot be used").String()
+	flag_accountFeatures = add.Flag("feature", "allowed feature (default to the server settings)").Enums(kish.FeatureHTTP, kish.FeatureTCP, kish.FeatureUDP, kish.FeatureTLS, kish.FeatureCustomHost)
+	flag_accountPubkey = add.Flag("pubkey", "public key printed by kish keygen instead of a new secret").String()
+	flag_accountAllowIP = add.Flag("allow-ip", "CIDR from which the account can open tunnels (default to any)").Strings()
+	flag_accountAddID = add.Arg("key-id", "").Required().String()
+
+	account.Command("list", "list accounts without secrets")
+
+	disable := account.Command("disable", "disable an account")
+	flag_disableUndo = disable.Flag("undo", "enable the account again").Bool()
+	flag_disableID = disable.Arg("key-id", "").Required().String()
+
+	rotate := account.Command("rotate", "add a new key and expire the current ones after the overlap")
+	flag_rotateOverlap = rotate.Flag("overlap", "period during which both the current and the new key are accepted").Default("168h").Duration()
+	flag_rotatePubkey = rotate.Flag("pubkey", "public key printed by kish keygen instead of a new secret").String()
+	flag_rotateID = rotate.Arg("key-id", "").Required().String()
+
+	remove := account.Command("remove", "remove an account")
+	flag_removeID = remove.Arg("key-id", "").Required().String()
+
+	revoke := account.Command("revoke", "revoke a delegation token issued by kish delegate")
+	flag_revokeID = revoke.Arg("key-id", "").Required().String()
+	flag_revokeTokenID = revoke.Arg("token-id", "").Required().String()
+
+	return kingpin.MustParse(app.Parse(os.Args[1:]))
 }
 
 func loadConfig(path string) error {
@@ -45,30 +153,172 @@ func loadConfig(path string) error {
 }
 
 func main() {
-	configFile := parse()
-	err := loadConfig(configFile)
+	command := parse()
+	if *flag_configFile != "" {
+		err := loadConfig(*flag_configFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := setupLogging(); err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	if command == "serve" {
+		if *flag_configFile == "" {
+			kingpin.Fatalf("--config is required")
+		}
+		serverMain()
+		return
+	}
+	if err := accountMain(command); err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+}
+
+// フラグが設定ファイルより優先される
+func setupLogging() error {
+	if *flag_logLevel != "" {
+		config.LogLevel = *flag_logLevel
+	}
+	if *flag_logFormat != "" {
+		config.LogFormat = *flag_logFormat
+	}
+	level, err := kish.ParseLogLevel(config.LogLevel)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	h, err := kish.NewLogHandler(os.Stderr, config.LogFormat, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+func keyStore() (kish.KeyStore, error) {
+	var stores []kish.KeyStore
+	if config.TokenSetPath != "" {
+		ts := &kish.TokenSet{Path: config.TokenSetPath}
+		if err := ts.Load(); err != nil {
+			return nil, err
+		}
+		stores = append(stores, ts)
+	}
+	if config.AccountDir != "" {
+		stores = append(stores, &kish.DirKeyStore{Dir: config.AccountDir})
+	}
+	if config.AccountEnvPrefix != "" {
+		stores = append(stores, &kish.EnvKeyStore{Prefix: config.AccountEnvPrefix})
+	}
+	if config.AccountURL != "" {
+		s := &kish.HTTPKeyStore{URL: config.AccountURL}
+		if config.AccountURLToken != "" {
+			s.Header = http.Header{"Authorization": {"Bearer " + config.AccountURLToken}}
+		}
+		stores = append(stores, s)
+	}
+	if len(stores) != 1 {
+		return nil, errors.New("specify exactly one of account, account-dir, account-env-prefix and account-url")
+	}
+	return stores[0], nil
+}
+
+// 設定されていなければnil
+func auditLog() *kish.AuditLog {
+	if config.AuditLog == nil || config.AuditLog.Path == "" {
+		return nil
+	}
+	return &kish.AuditLog{
+		Path:       config.AuditLog.Path,
+		MaxSize:    config.AuditLog.MaxSizeMB << 20,
+		MaxBackups: config.AuditLog.MaxBackups,
+	}
+}
+
+func accessLog() *kish.AccessLogConfig {
+	if config.AccessLog == nil || config.AccessLog.Dir == "" {
+		return nil
+	}
+	return &kish.AccessLogConfig{
+		Dir:        config.AccessLog.Dir,
+		Format:     config.AccessLog.Format,
+		MaxSize:    config.AccessLog.MaxSizeMB << 20,
+		MaxBackups: config.AccessLog.MaxBackups,
+		MaxAge:     config.AccessLog.MaxAge,
 	}
-	serverMain()
 }
 
 func serverMain() {
-	log.Printf("config dump: %#v", config)
+	// 秘密情報を含む項目は出さない
+	slog.Debug("config",
+		"host", config.Host,
+		"domain_suffix", config.DomainSuffix,
+		"listen", config.ListenAddr,
+		"trust_x_forwarded_for", config.TrustXFF,
+		"account", config.TokenSetPath,
+		"account_dir", config.AccountDir,
+		"account_env_prefix", config.AccountEnvPrefix,
+		"account_url", config.AccountURL,
+		"enable_tcp_forwarding", config.EnableTCPForwarding,
+		"enable_udp_forwarding", config.EnableUDPForwarding,
+		"require_signed_parameters", config.RequireSignedParams,
+		"request_client_cert", config.RequestClientCert,
+		"oidc", config.OIDC != nil,
+	)
 	rs := &kish.KishServer{
-		Host:                config.Host,
-		ProxyDomainSuffix:   config.DomainSuffix,
-		TokenSet:            &kish.TokenSet{Path: config.TokenSetPath},
-		TrustXFF:            config.TrustXFF,
-		EnableTCPForwarding: config.EnableTCPForwarding,
-	}
-	rs.Init()
-	var err error
-	if config.TLSCert != "" {
-		err = http.ListenAndServeTLS(config.ListenAddr, config.TLSCert, config.TLSKey, rs)
-	} else {
-		err = http.ListenAndServe(config.ListenAddr, rs)
+		Host:                    config.Host,
+		ProxyDomainSuffix:       config.DomainSuffix,
+		TrustXFF:                config.TrustXFF,
+		EnableTCPForwarding:     config.EnableTCPForwarding,
+		EnableUDPForwarding:     config.EnableUDPForwarding,
+		RequireSignedParameters: config.RequireSignedParams,
+		RequestClientCert:       config.RequestClientCert,
+		AuditLog:                auditLog(),
+		AccessLog:               accessLog(),
+		AllowJWKSURLs:           config.AllowJWKSURLs,
+		ReplayCache: &kish.ReplayCache{
+			Path:       config.ReplayCacheFile,
+			MaxEntries: config.ReplayCacheSize,
+		},
+	}
+	ks, err := keyStore()
+	if err != nil {
+		panic(err)
+	}
+	rs.KeyStore = ks
+	if err := rs.ReplayCache.Load(time.Now()); err != nil {
+		panic(err)
+	}
+	if config.OIDC != nil {
+		oc := &kish.OIDCConfig{
+			Issuer:          config.OIDC.Issuer,
+			ClientID:        config.OIDC.ClientID,
+			ClientSecret:    config.OIDC.ClientSecret,
+			RedirectURL:     config.OIDC.RedirectURL,
+			Scopes:          config.OIDC.Scopes,
+			GroupsClaim:     config.OIDC.GroupsClaim,
+			SessionLifetime: config.OIDC.SessionLifetime,
+		}
+		if config.OIDC.CookieKey != "" {
+			key, err := base64.StdEncoding.DecodeString(config.OIDC.CookieKey)
+			if err != nil {
+				panic(err)
+			}
+			oc.CookieKey = key
+		}
+		rs.OIDC = oc
+	}
+	if err := rs.Init(); err != nil {
+		panic(err)
+	}
+	if config.StatusListen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", rs.StatusHandler)
+		go func() {
+			slog.Error("status listener stopped", "err", http.ListenAndServe(config.StatusListen, mux))
+		}()
 	}
+	err = rs.ListenAndServe(config.ListenAddr, config.TLSCert, config.TLSKey)
 	if err != nil {
 		panic(err)
 	}
@@ -1,27 +1,58 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
 	"github.com/no2a/kish"
 )
 
 func parseKey(key string) (string, string) {
 	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
 	return parts[0], parts[1]
 }
 
+// トークンに署名する鍵を返す。共有秘密鍵なら[]byte、private-keyが設定されていればcrypto.Signer
+func signingKey() (string, interface{}, error) {
+	keyID, keySecret := parseKey(config.Key)
+	if keyID == "" {
+		return "", nil, errors.New("key is invalid")
+	}
+	if config.PrivateKey != "" {
+		b, err := os.ReadFile(config.PrivateKey)
+		if err != nil {
+			return "", nil, err
+		}
+		signer, err := kish.ParsePrivateKeyPEM(b)
+		if err != nil {
+			return "", nil, fmt.Errorf("private-key `%s` is invalid: %w", config.PrivateKey, err)
+		}
+		return keyID, signer, nil
+	}
+	if keySecret == "" {
+		return "", nil, errors.New("key is invalid")
+	}
+	return keyID, []byte(keySecret), nil
+}
+
 func canonicalizeTargetArg(target string) string {
 	host, port, err := net.SplitHostPort(target)
 	if err != nil {
@@ -43,37 +74,63 @@ func canonicalizeTargetArg(target string) string {
 	return net.JoinHostPort(host, port)
 }
 
-func dialKish(pathAppend string) (*websocket.Conn, string, http.Header) {
+// sessionがnilでなければkish startで張った/sessionの上でwebsocketをつなぐ
+func dialKish(session *yamux.Session, pathAppend string, params *kish.ProxyParameters) (*websocket.Conn, string, http.Header, error) {
 	wsURL, err := url.Parse(config.KishURL)
 	if err != nil {
-		log.Fatalf("kish-url `%s` is invalid: %s", config.KishURL, err)
+		return nil, "", nil, fmt.Errorf("kish-url `%s` is invalid: %w", config.KishURL, err)
 	}
-	wsURL.Path = path.Join(wsURL.Path, pathAppend)
-
-	keyID, keySecret := parseKey(config.Key)
-	if keyID == "" || keySecret == "" {
-		log.Fatalf("key is invalid")
+	origin := mapWsToHttp(wsURL.Scheme) + "://" + wsURL.Host
+	dialer := websocket.DefaultDialer
+	if session != nil {
+		// TLSは外側で済んでいるのでストリームの上では平文でよい
+		wsURL = &url.URL{Scheme: "ws", Host: wsURL.Host, Path: "/" + pathAppend}
+		dialer = &websocket.Dialer{
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return session.Open()
+			},
+		}
+	} else {
+		wsURL.Path = path.Join(wsURL.Path, pathAppend)
 	}
-	token, err := kish.GenerateToken(time.Now(), []byte(keySecret), keyID)
+
+	paramStr, err := base64str(params)
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", nil, err
 	}
-	origin := mapWsToHttp(wsURL.Scheme) + "://" + wsURL.Host
-	params := kish.ProxyParameters{
-		Host:      config.Host,
-		AllowIP:   config.Restriction.AllowIP,
-		AllowMyIP: config.Restriction.AllowMyIP,
-		BasicAuth: config.Restriction.Auth,
+	opts := []kish.TokenOption{kish.WithAudience(wsURL.Hostname()), kish.WithParameters(paramStr)}
+	var keyID string
+	var key interface{}
+	if config.Delegation != "" {
+		d, err := kish.ParseDelegation(config.Delegation)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		keyID, key = d.Claims.KeyID, d.Signer
+		opts = append(opts, kish.WithDelegation(d.Token))
+	} else {
+		keyID, key, err = signingKey()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if config.KeyVersion != "" {
+			opts = append(opts, kish.WithKeyVersion(config.KeyVersion))
+		}
 	}
-	paramStr, err := base64str(&params)
+	token, err := kish.GenerateToken(time.Now(), key, keyID, opts...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", nil, err
 	}
-	wsConn, proxyURL, header, err := makeWsConn(wsURL.String(), origin, token, paramStr)
+	return makeWsConn(dialer, wsURL.String(), origin, token, paramStr)
+}
+
+func openKishSession() (*yamux.Session, error) {
+	wsConn, _, _, err := dialKish(nil, "session", &kish.ProxyParameters{})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return wsConn, proxyURL, header
+	// 各トンネルのストリームはサーバー側でAcceptされる
+	return yamux.Client(kish.MakeRWC(wsConn), nil)
 }
 
 func base64str(pp *kish.ProxyParameters) (string, error) {
@@ -87,12 +144,12 @@ func base64str(pp *kish.ProxyParameters) (string, error) {
 	return string(b), nil
 }
 
-func makeWsConn(wsUrl string, origin string, token string, param string) (*websocket.Conn, string, http.Header, error) {
+func makeWsConn(dialer *websocket.Dialer, wsUrl string, origin string, token string, param string) (*websocket.Conn, string, http.Header, error) {
 	header := http.Header{}
 	header.Set("X-Kish-HTTP", param)
 	header.Set("Authorization", "Bearer "+token)
 	header.Set("Origin", origin)
-	conn, resp, err := websocket.DefaultDialer.Dial(wsUrl, header)
+	conn, resp, err := dialer.Dial(wsUrl, header)
 	if err != nil {
 		if resp != nil {
 			msg := resp.Header.Get("X-Error-Message")
@@ -105,13 +162,44 @@ func makeWsConn(wsUrl string, origin string, token string, param string) (*webso
 		}
 		return nil, "", nil, err
 	}
+	warnKeyExpiry(resp.Header.Get("X-Kish-Key-Expires"), time.Now())
 	proxyURL := resp.Header.Get("X-Kish-URL")
 	return conn, proxyURL, resp.Header, nil
 }
 
+// この期間内に鍵が期限切れになる場合に警告する
+const keyExpiryWarning = 14 * 24 * time.Hour
+
+var keyExpiryWarned sync.Once
+
+// トンネルごとに出るとうるさいので1回だけ
+func warnKeyExpiry(value string, now time.Time) {
+	if value == "" {
+		return
+	}
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil || expires.Sub(now) > keyExpiryWarning {
+		return
+	}
+	keyExpiryWarned.Do(func() {
+		if config.Delegation != "" {
+			slog.Warn("delegation token expires soon, issue a new one before then", "expires", expires.Local().Format(time.DateTime))
+			return
+		}
+		keyID, _ := parseKey(config.Key)
+		slog.Warn("key expires soon, rotate it before then", "key", keyID, "expires", expires.Local().Format(time.DateTime))
+	})
+}
+
 func mapWsToHttp(scheme string) string {
 	if scheme == "wss" {
 		return "https"
 	}
 	return "http"
 }
+
+// slogにはFatalがないので代わりに使う
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
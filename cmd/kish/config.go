@@ -3,20 +3,89 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
+	"github.com/no2a/kish"
 	"gopkg.in/yaml.v3"
 )
 
+type RestrictionConfig struct {
+	AllowIP   []string `yaml:"ip"`
+	AllowMyIP bool     `yaml:"allow-my-ip"`
+	// 値は平文かbcrypt, argon2, SHA-cryptのハッシュ
+	Auth     map[string]string `yaml:"auth"`
+	Htpasswd string            `yaml:"htpasswd"`
+	// ブラウザのBasic認証ダイアログの代わりにログインページを出す
+	LoginForm bool `yaml:"login-form"`
+	// Authorization: Bearerで送られてくる値
+	APIKeys   []string              `yaml:"api-keys"`
+	TokenAuth []TokenAuthConfig     `yaml:"token-auth"`
+	JWT       *JWTRestrictionConfig `yaml:"jwt"`
+	// クライアント証明書を発行したCAのPEMファイル。サーバーでrequest-client-certが必要
+	ClientCA       string   `yaml:"client-ca"`
+	ClientSubjects []string `yaml:"client-subjects"`
+	// サーバーでOIDCが設定されている場合のみ使える
+	OIDC *OIDCRestrictionConfig `yaml:"oidc"`
+}
+
+// headerかqueryのどちらか
+type TokenAuthConfig struct {
+	Header string `yaml:"header"`
+	Query  string `yaml:"query"`
+	Value  string `yaml:"value"`
+}
+
+// jwks-urlかjwks-fileのどちらか。jwks-fileはこのマシンで読んでサーバーに送る。
+// jwks-urlはサーバーのallow-jwks-urlsで許可されている必要がある
+type JWTRestrictionConfig struct {
+	JWKSURL        string            `yaml:"jwks-url"`
+	JWKSFile       string            `yaml:"jwks-file"`
+	Issuer         string            `yaml:"issuer"`
+	Audience       string            `yaml:"audience"`
+	RequiredClaims map[string]string `yaml:"required-claims"`
+	ForwardClaims  map[string]string `yaml:"forward-claims"`
+}
+
+type OIDCRestrictionConfig struct {
+	// "alice@example.com"か"@example.com"
+	Emails []string `yaml:"emails"`
+	Groups []string `yaml:"groups"`
+}
+
+// kish startで起動するトンネルの定義
+type TunnelConfig struct {
+	Name   string `yaml:"name"`
+	Type   string `yaml:"type"`
+	Target string `yaml:"target"`
+	Host   string `yaml:"hostname"`
+	// 省略した場合はトップレベルのrestrictionを使う
+	Restriction   *RestrictionConfig `yaml:"restriction"`
+	HostHeader    string             `yaml:"host-header"`
+	ModifyReferer bool               `yaml:"modify-referer"`
+	Private       string             `yaml:"private"`
+	AllowAccounts []string           `yaml:"allow-accounts"`
+	IdleTimeout   time.Duration      `yaml:"idle-timeout"`
+	// httpのみ。combinedかjsonを指定すると訪問者のリクエストを表示する
+	AccessLog string `yaml:"access-log"`
+}
+
 type ClientConfig struct {
-	KishURL     string `yaml:"kish-url"`
-	Key         string `yaml:"key"`
-	Host        string `yaml:"hostname"`
-	Restriction struct {
-		AllowIP   []string          `yaml:"ip"`
-		AllowMyIP bool              `yaml:"allow-my-ip"`
-		Auth      map[string]string `yaml:"auth"`
-	} `yaml:"restriction"`
+	KishURL string `yaml:"kish-url"`
+	// "keyID/secret"。private-keyを使う場合は"keyID"だけ
+	Key        string `yaml:"key"`
+	PrivateKey string `yaml:"private-key"`
+	// アカウントにkeysを書いている場合、どの鍵かを示す
+	KeyVersion string `yaml:"key-version"`
+	// kish delegateで作った委任トークン。keyの代わりに使う
+	Delegation  string            `yaml:"delegation"`
+	Host        string            `yaml:"hostname"`
+	Restriction RestrictionConfig `yaml:"restriction"`
+	Tunnels     []TunnelConfig    `yaml:"tunnels"`
+	// debug, info, warn, error
+	LogLevel string `yaml:"log-level"`
+	// textかjson
+	LogFormat string `yaml:"log-format"`
 }
 
 var (
@@ -26,12 +95,41 @@ var (
 	flag_hostname_passed  bool
 	flag_allowMyIP        *bool
 	flag_allowMyIP_passed bool
+	flag_logLevel         *string
+	flag_logFormat        *string
 
-	flag_httpTarget *string
-	flag_hostHeader *string
+	flag_httpTarget    *string
+	flag_hostHeader    *string
 	flag_modifyReferer *bool
+	flag_httpAccessLog *string
+
+	flag_tcpTarget        *string
+	flag_tcpPrivate       *string
+	flag_tcpAllowAccounts *[]string
+
+	flag_tlsTarget *string
 
-	flag_tcpTarget *string
+	flag_udpTarget      *string
+	flag_udpIdleTimeout *time.Duration
+
+	flag_connectName   *string
+	flag_connectListen *string
+
+	flag_startNames *[]string
+
+	flag_shareHost   *string
+	flag_sharePath   *string
+	flag_shareExpire *time.Duration
+
+	flag_delegateHosts       *[]string
+	flag_delegateTypes       *[]string
+	flag_delegateExpire      *time.Duration
+	flag_delegateMaxLifetime *time.Duration
+	flag_delegateName        *string
+
+	flag_keygenKeyID *string
+	flag_keygenType  *string
+	flag_keygenOut   *string
 
 	config ClientConfig
 )
@@ -56,18 +154,61 @@ func parseArgs() (string, func()) {
 		Action(setPassed(&flag_hostname_passed)).String()
 	flag_allowMyIP = app.Flag("allow-my-ip", "automatically add global IP of this machine to allow-ip").
 		Action(setPassed(&flag_allowMyIP_passed)).Bool()
+	flag_logLevel = app.Flag("log-level", "debug, info, warn or error (default to log-level in the config file)").String()
+	flag_logFormat = app.Flag("log-format", "text or json (default to log-format in the config file)").String()
 
 	http := app.Command("http", "")
 	flag_hostHeader = http.Flag("host-header", "value of Host header of forawarded requests").String()
 	flag_modifyReferer = http.Flag("modify-referer", "replace scheme and host part of incoming referer header").Bool()
+	flag_httpAccessLog = http.Flag("access-log", "show requests from visitors in this format").Enum(kish.AccessLogCombined, kish.AccessLogJSON)
 	flag_httpTarget = http.Arg("target", "").Required().String()
 
 	tcp := app.Command("tcp", "")
+	flag_tcpPrivate = tcp.Flag("private", "publish as a private tunnel with this name instead of opening a port").String()
+	flag_tcpAllowAccounts = tcp.Flag("allow-account", "key ID allowed to connect to the private tunnel (* for any)").Strings()
 	flag_tcpTarget = tcp.Arg("target", "").Required().String()
 
+	tls := app.Command("tls", "pass TLS connections through to target without terminating them")
+	flag_tlsTarget = tls.Arg("target", "").Required().String()
+
+	udp := app.Command("udp", "")
+	flag_udpIdleTimeout = udp.Flag("idle-timeout", "forget a visitor after this period of inactivity").Default(defaultUDPIdleTimeout.String()).Duration()
+	flag_udpTarget = udp.Arg("target", "").Required().String()
+
+	connect := app.Command("connect", "connect to a private tunnel")
+	flag_connectName = connect.Arg("name", "").Required().String()
+	flag_connectListen = connect.Arg("local-port", "").Required().String()
+
+	start := app.Command("start", "start tunnels defined in the config file (all if no name is given)")
+	flag_startNames = start.Arg("names", "").Strings()
+
+	share := app.Command("share", "print a link that lets visitors skip authentication of a running http tunnel for a while")
+	flag_shareExpire = share.Flag("expire", "validity period of the link").Default("2h").Duration()
+	flag_shareHost = share.Arg("hostname", "hostname or URL of the tunnel").Required().String()
+	flag_sharePath = share.Arg("path", "path to open").Default("/").String()
+
+	delegate := app.Command("delegate", "print a restricted token that CI can use instead of the key")
+	flag_delegateHosts = delegate.Flag("host", "hostname pattern like ci-*.kish.example.com (default to any)").Strings()
+	flag_delegateTypes = delegate.Flag("type", "allowed tunnel type (default to any)").Enums("http", "tcp", "udp", "tls")
+	flag_delegateExpire = delegate.Flag("expire", "validity period of the token").Default("720h").Duration()
+	flag_delegateMaxLifetime = delegate.Flag("max-tunnel-lifetime", "close each tunnel after this period (default to the expiry of the token)").Duration()
+	flag_delegateName = delegate.Flag("name", "description of the token such as the name of the pipeline").String()
+
+	keygen := app.Command("keygen", "generate a private key for the client and print the public key for the server")
+	flag_keygenType = keygen.Flag("type", "key type").Default("ed25519").Enum("ed25519", "ecdsa", "rsa")
+	flag_keygenOut = keygen.Flag("out", "file to write the private key to (default to .kish-<key-id>.pem in the home directory)").String()
+	flag_keygenKeyID = keygen.Arg("key-id", "").Required().String()
+
 	commandMain := map[string]func(){
-		"http": httpMain,
-		"tcp":  tcpMain,
+		"http":     httpMain,
+		"tcp":      tcpMain,
+		"tls":      tlsMain,
+		"udp":      udpMain,
+		"connect":  connectMain,
+		"start":    startMain,
+		"share":    shareMain,
+		"delegate": delegateMain,
+		"keygen":   keygenMain,
 	}
 
 	command, err := app.Parse(os.Args[1:])
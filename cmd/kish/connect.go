@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/hashicorp/yamux"
+	"github.com/no2a/kish"
+)
+
+func connectMain() {
+	listenAddr := canonicalizeTargetArg(*flag_connectListen)
+	if listenAddr == "" {
+		fatal(fmt.Errorf("local-port `%s` is invalid", *flag_connectListen))
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		fatal(err)
+	}
+	defer listener.Close()
+	params := &kish.ProxyParameters{Private: *flag_connectName}
+	wsConn, _, _, err := dialKish(nil, "connect", params)
+	if err != nil {
+		fatal(err)
+	}
+	tuiWriteText(fmt.Sprintf("%s -> private://%s\n", listener.Addr(), *flag_connectName))
+	err = connectRun(kish.MakeRWC(wsConn), listener)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func connectRun(conn io.ReadWriteCloser, listener net.Listener) error {
+	defer conn.Close()
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	go func() {
+		// トンネルが閉じられたらAcceptを止める
+		<-session.CloseChan()
+		listener.Close()
+	}()
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go connectForward(localConn, session)
+	}
+}
+
+func connectForward(localConn net.Conn, session *yamux.Session) {
+	defer localConn.Close()
+	stream, err := session.Open()
+	if err != nil {
+		slog.Warn("session.Open failed", "err", err)
+		return
+	}
+	defer stream.Close()
+	err = kish.Passthrough(localConn, stream)
+	if err != nil {
+		slog.Debug("Passthrough ended with error", "err", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/no2a/kish"
+)
+
+func delegateMain() {
+	if config.Delegation != "" {
+		fatal(errors.New("delegation token cannot issue another delegation token"))
+	}
+	keyID, key, err := signingKey()
+	if err != nil {
+		fatal(err)
+	}
+	now := time.Now()
+	c := kish.DelegationClaims{
+		KeyID:             keyID,
+		KeyVersion:        config.KeyVersion,
+		Hosts:             *flag_delegateHosts,
+		Types:             *flag_delegateTypes,
+		MaxTunnelLifetime: int64(flag_delegateMaxLifetime.Seconds()),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   *flag_delegateName,
+			ExpiresAt: jwt.NewNumericDate(now.Add(*flag_delegateExpire)),
+		},
+	}
+	// kish-serverのホスト名に限定しておく
+	if u, err := url.Parse(config.KishURL); err == nil {
+		c.Audience = jwt.ClaimStrings{u.Hostname()}
+	}
+	token, err := kish.MakeDelegation(now, key, c)
+	if err != nil {
+		fatal(err)
+	}
+	d, err := kish.ParseDelegation(token)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("the token is valid until %s\n", d.Claims.ExpiresAt.Local().Format(time.DateTime))
+	fmt.Printf("to revoke it, run on the server:\n\n")
+	fmt.Printf("kish-server account revoke %s %s\n\n", keyID, d.Claims.ID)
+	fmt.Printf("use these lines as the client config instead of key:\n\n")
+	fmt.Printf("kish-url: %s\ndelegation: %s\n", config.KishURL, token)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/no2a/kish"
+)
+
+// user:hash の形式。htpasswdのデフォルト(apr1)や-s ({SHA}), -d (DES crypt)には対応していないので -B (bcrypt) で作ること。
+// 平文として扱うとハッシュ文字列そのものがパスワードになってしまうので、"$"で始まらないものも受け付けない
+func loadHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: malformed line", path, lineNo)
+		}
+		if !kish.IsSupportedPasswordHash(hash) {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for %s (use bcrypt, argon2 or SHA-crypt)", path, lineNo, user)
+		}
+		m[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
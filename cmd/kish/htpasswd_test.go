@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadHtpasswd(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "htpasswd")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	m, err := loadHtpasswd(write("# comment\n\nalice:$2y$05$abcdefghijklmnopqrstuuUVO.MAxVIWHiu5XCWgr.U2qVp.7XKRi\nbob:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1\n"))
+	if err != nil || len(m) != 2 || !strings.HasPrefix(m["alice"], "$2y$") {
+		t.Errorf("unexpected: %v %v", m, err)
+	}
+
+	// ハッシュ文字列そのものでログインできないように、平文と未対応のハッシュは行番号付きで拒否する
+	for _, line := range []string{
+		"carol:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=",
+		"carol:$apr1$abcdefgh$0123456789abcdefghijkl",
+		"carol:plaintext",
+		"carol:rq9LzbB2s7pDA",
+		"carol",
+	} {
+		_, err := loadHtpasswd(write("alice:$2y$05$abcdefghijklmnopqrstuuUVO.MAxVIWHiu5XCWgr.U2qVp.7XKRi\n" + line + "\n"))
+		if err == nil || !strings.Contains(err.Error(), ":2:") {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+}
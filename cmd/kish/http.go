@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
@@ -15,6 +15,9 @@ import (
 )
 
 type KishClientHTTP struct {
+	logger           *slog.Logger
+	label            string
+	accessLog        string
 	proxyURL         string
 	target           string
 	hostHeader       string
@@ -24,25 +27,59 @@ type KishClientHTTP struct {
 }
 
 func httpMain() {
-	target := canonicalizeTargetArg(*flag_httpTarget)
-	wsConn, proxyURL, header := dialKish("proxy2")
-	tuiWriteText(fmt.Sprintf("%s -> %s\n", proxyURL, target))
-	tuiWriteText(fmt.Sprintf("Allow IP: %s\n", header.Get("X-Kish-Allow-IP")))
+	tc := &TunnelConfig{
+		Type:          "http",
+		Target:        *flag_httpTarget,
+		Host:          config.Host,
+		HostHeader:    *flag_hostHeader,
+		ModifyReferer: *flag_modifyReferer,
+		AccessLog:     *flag_httpAccessLog,
+	}
+	err := runHttpTunnel(nil, tc)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func runHttpTunnel(session *yamux.Session, tc *TunnelConfig) error {
+	target := canonicalizeTargetArg(tc.Target)
+	if err := kish.CheckAccessLogFormat(tc.AccessLog); err != nil {
+		return fmt.Errorf("%s%w", tc.label(), err)
+	}
+	params, err := tc.proxyParameters()
+	if err != nil {
+		return err
+	}
+	params.AccessLog = tc.AccessLog != ""
+	wsConn, proxyURL, header, err := dialKish(session, "proxy2", params)
+	if err != nil {
+		return err
+	}
+	tuiWriteText(fmt.Sprintf("%s%s -> %s\n", tc.label(), proxyURL, target))
+	tuiWriteText(fmt.Sprintf("%sAllow IP: %s\n", tc.label(), header.Get("X-Kish-Allow-IP")))
+	if key := header.Get("X-Kish-Share-Key"); key != "" {
+		remove, err := saveShareState(proxyURL, key)
+		if err != nil {
+			tc.logger().Warn("cannot save the key for share links", "err", err)
+		} else {
+			defer remove()
+		}
+	}
 	kc := KishClientHTTP{
+		logger:     tc.logger(),
+		label:      tc.label(),
+		accessLog:  tc.AccessLog,
 		proxyURL:   proxyURL,
 		target:     target,
-		hostHeader: *flag_hostHeader,
+		hostHeader: tc.HostHeader,
 		// TODO: add ways to customize items below
 		originHeader:     "http://" + target,
 		locationHeaderSH: &url.URL{Scheme: "http", Host: target},
 	}
-	if *flag_modifyReferer {
+	if tc.ModifyReferer {
 		kc.refererHeaderSH = &url.URL{Scheme: "http", Host: target}
 	}
-	err := kc.httpRun(kish.MakeRWC(wsConn))
-	if err != nil {
-		log.Fatal(err)
-	}
+	return kc.httpRun(kish.MakeRWC(wsConn))
 }
 
 func (kc *KishClientHTTP) httpRun(conn io.ReadWriteCloser) error {
@@ -52,6 +89,7 @@ func (kc *KishClientHTTP) httpRun(conn io.ReadWriteCloser) error {
 		return err
 	}
 	defer session.Close()
+	go kc.receiveEvents(session)
 	for {
 		clientConn, err := session.Accept()
 		if err != nil {
@@ -65,7 +103,7 @@ func (kc *KishClientHTTP) httpForwardToTarget(clientConn io.ReadWriteCloser, tar
 	defer clientConn.Close()
 	targetConn, err := net.Dial("tcp", target)
 	if err != nil {
-		log.Printf("%s\n", err)
+		kc.logger.Warn("cannot connect to target", "err", err)
 		return
 	}
 	defer targetConn.Close()
@@ -77,12 +115,46 @@ func (kc *KishClientHTTP) httpForwardToTarget(clientConn io.ReadWriteCloser, tar
 	kish.ForwardHTTP(rr, targetConn, kc.modifyHeader, nil)
 }
 
+// サーバーからのイベント(認証のロックアウトなど)を受け取ってログに出す
+func (kc *KishClientHTTP) receiveEvents(session *yamux.Session) {
+	// こちらからストリームを開くとサーバーがイベント用として受け付ける
+	stream, err := session.Open()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	kish.ReadTunnelEvents(stream, func(ev kish.TunnelEvent) {
+		if ev.Type == kish.EventAccess {
+			kc.printAccessLog(ev.Access)
+			return
+		}
+		kc.logger.Warn(ev.Message, "event", ev.Type, "remote_ip", ev.RemoteIP)
+	})
+}
+
+// アクセスログはslogを通さず、その形式のまま出す
+func (kc *KishClientHTTP) printAccessLog(e *kish.AccessLogEntry) {
+	if e == nil || kc.accessLog == "" {
+		return
+	}
+	b, err := e.Format(kc.accessLog)
+	if err != nil {
+		return
+	}
+	// jsonは1行ずつ読めるようにラベルをつけない。ホスト名が入っている
+	if kc.accessLog == kish.AccessLogJSON {
+		tuiWriteLog(string(b) + "\n")
+	} else {
+		tuiWriteLog(kc.label + string(b) + "\n")
+	}
+}
+
 func replaceSHIfHasPrefix(header *http.Header, name string, prefix string, scheme string, host string) {
 	valStr := header.Get(name)
 	if strings.HasPrefix(valStr, prefix) {
 		valURL, err := url.Parse(valStr)
 		if err != nil {
-			log.Printf("could not parse %s header as a url: %v", name, err)
+			slog.Debug("could not parse header as a url", "header", name, "err", err)
 		} else {
 			valURL.Scheme = scheme
 			valURL.Host = host
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/no2a/kish"
+)
+
+func keygenMain() {
+	keyID := *flag_keygenKeyID
+	out := *flag_keygenOut
+	if out == "" {
+		homedir, err := os.UserHomeDir()
+		if err != nil {
+			fatal(err)
+		}
+		out = filepath.Join(homedir, ".kish-"+keyID+".pem")
+	}
+	priv, err := kish.GeneratePrivateKey(*flag_keygenType)
+	if err != nil {
+		fatal(err)
+	}
+	b, err := kish.MarshalPrivateKeyPEM(priv)
+	if err != nil {
+		fatal(err)
+	}
+	pub, err := kish.MarshalPublicKeyString(priv.Public())
+	if err != nil {
+		fatal(err)
+	}
+	// 既存の鍵を上書きしないようにO_EXCLで作る
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("private key has been written to %s\n\n", out)
+	fmt.Printf("add this line to the account file of kish-server:\n\n")
+	fmt.Printf("%s: %s\n\n", keyID, pub)
+	fmt.Printf("and these lines to the client config:\n\n")
+	fmt.Printf("key: %s\nprivate-key: %s\n", keyID, out)
+}
@@ -2,13 +2,20 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+
+	"github.com/no2a/kish"
 )
 
 func main() {
-	_, fMain := parseArgs()
+	command, fMain := parseArgs()
 	err := func() error {
+		if command == "keygen" || command == "share" {
+			// keygenは設定ファイルがまだない状態で使う。shareはサーバーに接続しない
+			return nil
+		}
 		configPath, err := configPath(*flag_configFile)
 		if err != nil {
 			return err
@@ -21,8 +28,14 @@ func main() {
 	}()
 	if err == nil {
 		if *flag_enableTUI {
-			tuiInit()
-			log.SetOutput(tuiLog)
+			tuiInit(tuiTextHeight(command))
+			err = setupLogging(tuiLog)
+		} else {
+			err = setupLogging(os.Stderr)
+		}
+	}
+	if err == nil {
+		if *flag_enableTUI {
 			// go tunRun()にするとctrl-Cを2回押さないと終了しなかったのでcmdのほうをgoする
 			go fMain()
 			err = tuiRun()
@@ -35,3 +48,23 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// フラグが設定ファイルより優先される
+func setupLogging(w io.Writer) error {
+	if *flag_logLevel != "" {
+		config.LogLevel = *flag_logLevel
+	}
+	if *flag_logFormat != "" {
+		config.LogFormat = *flag_logFormat
+	}
+	level, err := kish.ParseLogLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	h, err := kish.NewLogHandler(w, config.LogFormat, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
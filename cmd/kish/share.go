@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/no2a/kish"
+)
+
+// 実行中のトンネルの共有リンク用の鍵。kish shareが読む
+type shareState struct {
+	URL string `json:"url"`
+	Key string `json:"key"`
+}
+
+// ホスト名の大文字小文字は区別しない。保存と読み込みのどちらもここを通すこと
+func shareStatePath(host string) (string, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homedir, ".kish-share", strings.ToLower(host)), nil
+}
+
+// 書き込んだファイルを消す関数を返す。トンネルを閉じると鍵はサーバー側で無効になるので、消し損ねても害はない
+func saveShareState(proxyURL string, key string) (func(), error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	path, err := shareStatePath(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(&shareState{URL: proxyURL, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	return func() { os.Remove(path) }, nil
+}
+
+func shareMain() {
+	host := *flag_shareHost
+	// URLをそのまま貼り付けてもよい
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	path, err := shareStatePath(host)
+	if err != nil {
+		fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		fatal(fmt.Errorf("no running http tunnel for %s", host))
+	}
+	if err != nil {
+		fatal(err)
+	}
+	var state shareState
+	if err := json.Unmarshal(b, &state); err != nil {
+		fatal(err)
+	}
+	key, err := base64.StdEncoding.DecodeString(state.Key)
+	if err != nil {
+		fatal(err)
+	}
+	exp := time.Now().Add(*flag_shareExpire)
+	link, err := kish.MakeShareURL(state.URL, key, *flag_sharePath, exp)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("%s\n", link)
+	fmt.Printf("valid until %s, or until the tunnel is closed\n", exp.Format(time.DateTime))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// namesが空なら全部
+func selectTunnels(names []string) ([]TunnelConfig, error) {
+	if len(config.Tunnels) == 0 {
+		return nil, fmt.Errorf("no tunnels are defined in the config file")
+	}
+	seen := map[string]bool{}
+	for _, tc := range config.Tunnels {
+		if tc.Name == "" {
+			return nil, fmt.Errorf("tunnel without name is defined")
+		}
+		if seen[tc.Name] {
+			return nil, fmt.Errorf("tunnel `%s` is defined more than once", tc.Name)
+		}
+		seen[tc.Name] = true
+	}
+	if len(names) == 0 {
+		return config.Tunnels, nil
+	}
+	var tunnels []TunnelConfig
+	for _, name := range names {
+		i := slices.IndexFunc(config.Tunnels, func(tc TunnelConfig) bool { return tc.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("tunnel `%s` is not defined", name)
+		}
+		tunnels = append(tunnels, config.Tunnels[i])
+	}
+	return tunnels, nil
+}
+
+func startMain() {
+	tunnels, err := selectTunnels(*flag_startNames)
+	if err != nil {
+		fatal(err)
+	}
+	session, err := openKishSession()
+	if err != nil {
+		fatal(err)
+	}
+	defer session.Close()
+	var wg sync.WaitGroup
+	for i := range tunnels {
+		tc := &tunnels[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := runTunnel(session, tc)
+			tc.logger().Info("tunnel has been closed", "err", err)
+		}()
+	}
+	wg.Wait()
+}
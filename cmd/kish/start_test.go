@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelectTunnels(t *testing.T) {
+	defer func(tunnels []TunnelConfig) { config.Tunnels = tunnels }(config.Tunnels)
+	for _, c := range []struct {
+		tunnels []TunnelConfig
+		names   []string
+		want    string
+		err     bool
+	}{
+		{[]TunnelConfig{{Name: "web"}, {Name: "db"}}, nil, "web,db", false},
+		{[]TunnelConfig{{Name: "web"}, {Name: "db"}}, []string{"db"}, "db", false},
+		{[]TunnelConfig{{Name: "web"}, {Name: "db"}}, []string{"db", "web"}, "db,web", false},
+		{[]TunnelConfig{{Name: "web"}, {Name: "db"}}, []string{"unknown"}, "", true},
+		{[]TunnelConfig{{Name: "web"}, {Name: "web"}}, nil, "", true},
+		{[]TunnelConfig{{Name: "web"}, {}}, []string{"web"}, "", true},
+		{nil, nil, "", true},
+	} {
+		config.Tunnels = c.tunnels
+		tunnels, err := selectTunnels(c.names)
+		if (err != nil) != c.err {
+			t.Errorf("%+v %v: err = %v", c.tunnels, c.names, err)
+			continue
+		}
+		var names []string
+		for _, tc := range tunnels {
+			names = append(names, tc.Name)
+		}
+		if got := strings.Join(names, ","); got != c.want {
+			t.Errorf("%+v %v: %s", c.tunnels, c.names, got)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 
 	"github.com/hashicorp/yamux"
@@ -11,32 +11,52 @@ import (
 )
 
 func tcpMain() {
-	target := canonicalizeTargetArg(*flag_tcpTarget)
-	wsConn, proxyURL, header := dialKish("proxy1")
-	tuiWriteText(fmt.Sprintf("%s -> %s\n", proxyURL, target))
-	tuiWriteText(fmt.Sprintf("Allow IP: %s\n", header.Get("X-Kish-Allow-IP")))
-	err := tcpRun(kish.MakeRWC(wsConn), target)
+	tc := &TunnelConfig{
+		Type:          "tcp",
+		Target:        *flag_tcpTarget,
+		Host:          config.Host,
+		Private:       *flag_tcpPrivate,
+		AllowAccounts: *flag_tcpAllowAccounts,
+	}
+	err := runTcpTunnel(nil, tc)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func runTcpTunnel(session *yamux.Session, tc *TunnelConfig) error {
+	target := canonicalizeTargetArg(tc.Target)
+	params, err := tc.proxyParameters()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	wsConn, proxyURL, header, err := dialKish(session, "proxy1", params)
+	if err != nil {
+		return err
+	}
+	tuiWriteText(fmt.Sprintf("%s%s -> %s\n", tc.label(), proxyURL, target))
+	if tc.Private == "" {
+		tuiWriteText(fmt.Sprintf("%sAllow IP: %s\n", tc.label(), header.Get("X-Kish-Allow-IP")))
 	}
+	return tcpRun(kish.MakeRWC(wsConn), target, tc.logger())
 }
 
-func tcpForwardToTarget(clientConn io.ReadWriteCloser, target string) {
+func tcpForwardToTarget(clientConn io.ReadWriteCloser, target string, logger *slog.Logger) {
 	defer clientConn.Close()
 	targetConn, err := net.Dial("tcp", target)
 	if err != nil {
-		log.Printf("%s\n", err)
+		logger.Warn("cannot connect to target", "err", err)
 		return
 	}
 	defer targetConn.Close()
 	err = kish.Passthrough(clientConn, targetConn)
 	if err != nil {
-		log.Printf("%s\n", err)
+		logger.Debug("Passthrough ended with error", "err", err)
 		return
 	}
 }
 
-func tcpRun(conn io.ReadWriteCloser, target string) error {
+func tcpRun(conn io.ReadWriteCloser, target string, logger *slog.Logger) error {
 	defer conn.Close()
 	session, err := yamux.Client(conn, nil)
 	if err != nil {
@@ -48,6 +68,6 @@ func tcpRun(conn io.ReadWriteCloser, target string) error {
 		if err != nil {
 			return err
 		}
-		go tcpForwardToTarget(clientConn, target)
+		go tcpForwardToTarget(clientConn, target, logger)
 	}
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/yamux"
+	"github.com/no2a/kish"
+)
+
+func tlsMain() {
+	tc := &TunnelConfig{
+		Type:   "tls",
+		Target: *flag_tlsTarget,
+		Host:   config.Host,
+	}
+	err := runTlsTunnel(nil, tc)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func runTlsTunnel(session *yamux.Session, tc *TunnelConfig) error {
+	target := canonicalizeTargetArg(tc.Target)
+	params, err := tc.proxyParameters()
+	if err != nil {
+		return err
+	}
+	wsConn, proxyURL, header, err := dialKish(session, "proxy3", params)
+	if err != nil {
+		return err
+	}
+	tuiWriteText(fmt.Sprintf("%s%s -> %s\n", tc.label(), proxyURL, target))
+	tuiWriteText(fmt.Sprintf("%sAllow IP: %s\n", tc.label(), header.Get("X-Kish-Allow-IP")))
+	// サーバーからはTLSのバイト列がそのまま来るのでTCPと同じように中継すればよい
+	return tcpRun(kish.MakeRWC(wsConn), target, tc.logger())
+}
@@ -21,7 +21,28 @@ func tuiWriteText(text string) {
 	}
 }
 
-func tuiInit() {
+// tuiLogがなければ標準出力に書く
+func tuiWriteLog(text string) {
+	if tuiLog != nil {
+		fmt.Fprint(tuiLog, text)
+	} else {
+		fmt.Print(text)
+	}
+}
+
+// トンネル1本につきURLとAllow IPの2行を表示する
+func tuiTextHeight(command string) int {
+	if command != "start" {
+		return 3
+	}
+	tunnels, err := selectTunnels(*flag_startNames)
+	if err != nil {
+		return 3
+	}
+	return len(tunnels)*2 + 1
+}
+
+func tuiInit(textHeight int) {
 	// なんかデフォルトだと黒背景白文字になってしまうので、元の端末の色にする
 	fg := tcell.ColorDefault
 	bg := tcell.ColorDefault
@@ -31,7 +52,7 @@ func tuiInit() {
 	tuiLog = tview.NewTextView().SetChangedFunc(func() { tuiApp.Draw() })
 	tuiLog.SetTextColor(fg).SetBackgroundColor(bg)
 	flex := tview.NewFlex().SetDirection(tview.FlexRow)
-	flex.AddItem(tuiText, 3, 1, false)
+	flex.AddItem(tuiText, textHeight, 1, false)
 	flex.AddItem(tuiLog, 0, 1, false)
 	tuiApp.SetRoot(flex, true)
 }
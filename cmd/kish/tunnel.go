@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/hashicorp/yamux"
+	"github.com/no2a/kish"
+)
+
+func (tc *TunnelConfig) restriction() *RestrictionConfig {
+	if tc.Restriction != nil {
+		return tc.Restriction
+	}
+	return &config.Restriction
+}
+
+func (tc *TunnelConfig) proxyParameters() (*kish.ProxyParameters, error) {
+	r := tc.restriction()
+	basicAuth, err := r.basicAuth()
+	if err != nil {
+		return nil, err
+	}
+	params := &kish.ProxyParameters{
+		Host:          tc.Host,
+		AllowIP:       r.AllowIP,
+		AllowMyIP:     r.AllowMyIP,
+		BasicAuth:     basicAuth,
+		LoginForm:     r.LoginForm,
+		APIKeys:       r.APIKeys,
+		Private:       tc.Private,
+		AllowAccounts: tc.AllowAccounts,
+	}
+	for _, ta := range r.TokenAuth {
+		params.TokenAuth = append(params.TokenAuth, kish.TokenAuth{
+			Header: ta.Header,
+			Query:  ta.Query,
+			Value:  ta.Value,
+		})
+	}
+	if r.ClientCA != "" {
+		b, err := os.ReadFile(r.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		params.ClientCA = string(b)
+		params.AllowSubjects = r.ClientSubjects
+	}
+	if r.JWT != nil {
+		params.JWT, err = r.JWT.parameters()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.OIDC != nil {
+		params.OIDC = &kish.OIDCParameters{
+			AllowEmails: r.OIDC.Emails,
+			AllowGroups: r.OIDC.Groups,
+		}
+	}
+	return params, nil
+}
+
+// htpasswdとauthを合わせたもの。同じユーザーがいればauthを優先する
+func (r *RestrictionConfig) basicAuth() (map[string]string, error) {
+	if r.Htpasswd == "" {
+		return r.Auth, nil
+	}
+	m, err := loadHtpasswd(r.Htpasswd)
+	if err != nil {
+		return nil, err
+	}
+	for user, pass := range r.Auth {
+		m[user] = pass
+	}
+	return m, nil
+}
+
+func (jc *JWTRestrictionConfig) parameters() (*kish.JWTParameters, error) {
+	jp := &kish.JWTParameters{
+		JWKSURL:        jc.JWKSURL,
+		Issuer:         jc.Issuer,
+		Audience:       jc.Audience,
+		RequiredClaims: jc.RequiredClaims,
+		ForwardClaims:  jc.ForwardClaims,
+	}
+	if jc.JWKSFile != "" {
+		b, err := os.ReadFile(jc.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		// ヘッダーに載せるので空白を詰めておく
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, b); err != nil {
+			return nil, fmt.Errorf("jwks-file `%s` is invalid: %w", jc.JWKSFile, err)
+		}
+		jp.JWKS = buf.Bytes()
+	}
+	return jp, nil
+}
+
+// 複数のトンネルを表示するときに区別するための接頭辞
+func (tc *TunnelConfig) label() string {
+	if tc.Name == "" {
+		return ""
+	}
+	return fmt.Sprintf("[%s] ", tc.Name)
+}
+
+func (tc *TunnelConfig) logger() *slog.Logger {
+	if tc.Name == "" {
+		return slog.Default()
+	}
+	return slog.With("tunnel", tc.Name)
+}
+
+func runTunnel(session *yamux.Session, tc *TunnelConfig) error {
+	switch tc.Type {
+	case "http":
+		return runHttpTunnel(session, tc)
+	case "tcp":
+		return runTcpTunnel(session, tc)
+	case "tls":
+		return runTlsTunnel(session, tc)
+	case "udp":
+		return runUdpTunnel(session, tc)
+	}
+	return fmt.Errorf("%sunknown tunnel type `%s`", tc.label(), tc.Type)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/no2a/kish"
+)
+
+const defaultUDPIdleTimeout = 60 * time.Second
+
+// 同時に持つソケットの上限。送信元を偽装されてもファイルディスクリプタを使い切らないように、
+// 超えたら一番使われていないものを閉じる
+const maxUDPFlows = 1024
+
+// 訪問者のアドレスごとにtargetへのUDPソケットを持ち、返信を正しい訪問者に返す
+type udpFlow struct {
+	addr       string
+	conn       *net.UDPConn
+	lastActive time.Time
+}
+
+type KishClientUDP struct {
+	logger      *slog.Logger
+	target      *net.UDPAddr
+	idleTimeout time.Duration
+	stream      io.Writer
+	mu          sync.Mutex
+	flows       map[string]*list.Element
+	// 先頭が最後に使われたフロー。Valueは*udpFlow。追い出しも期限切れも末尾から見ればよい
+	lru *list.List
+}
+
+func udpMain() {
+	tc := &TunnelConfig{
+		Type:        "udp",
+		Target:      *flag_udpTarget,
+		IdleTimeout: *flag_udpIdleTimeout,
+	}
+	err := runUdpTunnel(nil, tc)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func runUdpTunnel(session *yamux.Session, tc *TunnelConfig) error {
+	target := canonicalizeTargetArg(tc.Target)
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return err
+	}
+	idleTimeout := tc.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	if idleTimeout < 0 {
+		return fmt.Errorf("%sidle-timeout must be positive", tc.label())
+	}
+	params, err := tc.proxyParameters()
+	if err != nil {
+		return err
+	}
+	wsConn, proxyURL, _, err := dialKish(session, "proxy4", params)
+	if err != nil {
+		return err
+	}
+	tuiWriteText(fmt.Sprintf("%s%s -> %s\n", tc.label(), proxyURL, target))
+	kc := KishClientUDP{
+		logger:      tc.logger(),
+		target:      targetAddr,
+		idleTimeout: idleTimeout,
+		flows:       map[string]*list.Element{},
+		lru:         list.New(),
+	}
+	return kc.udpRun(kish.MakeRWC(wsConn))
+}
+
+func (kc *KishClientUDP) udpRun(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stream, err := session.Accept()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	kc.stream = stream
+	defer kc.closeAllFlows()
+	go kc.expireIdleFlows(session.CloseChan())
+	for {
+		addr, payload, err := kish.ReadUDPFrame(stream)
+		if err != nil {
+			return err
+		}
+		flow, err := kc.getFlow(addr)
+		if err != nil {
+			kc.logger.Warn("cannot connect to target", "err", err)
+			continue
+		}
+		if _, err := flow.conn.Write(payload); err != nil {
+			kc.logger.Debug("Write failed", "visitor", addr, "err", err)
+		}
+	}
+}
+
+func (kc *KishClientUDP) getFlow(addr string) (*udpFlow, error) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if e, ok := kc.flows[addr]; ok {
+		kc.touchFlow(e, time.Now())
+		return e.Value.(*udpFlow), nil
+	}
+	if kc.lru.Len() >= maxUDPFlows {
+		kc.removeFlow(kc.lru.Back())
+	}
+	conn, err := net.DialUDP("udp", nil, kc.target)
+	if err != nil {
+		return nil, err
+	}
+	flow := &udpFlow{addr: addr, conn: conn, lastActive: time.Now()}
+	kc.flows[addr] = kc.lru.PushFront(flow)
+	go kc.forwardReplies(addr, conn)
+	return flow, nil
+}
+
+// 以下はmuを取ってから呼ぶこと
+func (kc *KishClientUDP) touchFlow(e *list.Element, now time.Time) {
+	e.Value.(*udpFlow).lastActive = now
+	kc.lru.MoveToFront(e)
+}
+
+func (kc *KishClientUDP) removeFlow(e *list.Element) {
+	flow := e.Value.(*udpFlow)
+	flow.conn.Close()
+	kc.lru.Remove(e)
+	delete(kc.flows, flow.addr)
+}
+
+func (kc *KishClientUDP) forwardReplies(addr string, conn *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				kc.logger.Debug("Read failed", "visitor", addr, "err", err)
+			}
+			return
+		}
+		kc.mu.Lock()
+		// 追い出されて同じアドレスで作り直されたフローは別のconnを持つ
+		if e, ok := kc.flows[addr]; ok && e.Value.(*udpFlow).conn == conn {
+			kc.touchFlow(e, time.Now())
+		}
+		kc.mu.Unlock()
+		if err := kish.WriteUDPFrame(kc.stream, addr, buf[:n]); err != nil {
+			kc.logger.Debug("WriteUDPFrame failed", "err", err)
+			return
+		}
+	}
+}
+
+func (kc *KishClientUDP) expireIdleFlows(done <-chan struct{}) {
+	ticker := time.NewTicker(kc.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			kc.mu.Lock()
+			for e := kc.lru.Back(); e != nil && now.Sub(e.Value.(*udpFlow).lastActive) > kc.idleTimeout; e = kc.lru.Back() {
+				kc.removeFlow(e)
+			}
+			kc.mu.Unlock()
+		}
+	}
+}
+
+func (kc *KishClientUDP) closeAllFlows() {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	for e := kc.lru.Back(); e != nil; e = kc.lru.Back() {
+		kc.removeFlow(e)
+	}
+}
@@ -0,0 +1,224 @@
+package kish
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidDelegation         = errors.New("invalid delegation token")
+	ErrDelegationLifetimeTooLong = errors.New("lifetime of delegation token is too long")
+	ErrDelegationRevoked         = errors.New("delegation token has been revoked")
+	ErrDelegationKeyIDMismatch   = errors.New("key ID does not match the delegation token")
+)
+
+// 委任トークンの有効期間の上限
+const maxDelegationLifetime = 366 * 24 * time.Hour
+
+// 委任トークンで制限できるトンネルの種類
+var delegationTypes = []string{FeatureHTTP, FeatureTCP, FeatureUDP, FeatureTLS}
+
+// アカウントの鍵で署名し、CIなどに渡す。親アカウントより広い権限は持てない
+type DelegationClaims struct {
+	KeyID      string `json:"keyID"`
+	KeyVersion string `json:"keyVersion,omitempty"`
+	// "ci-*.kish.example.com"のようなpath.Matchのパターン。空ならどのホスト名でもよい
+	Hosts []string `json:"hosts,omitempty"`
+	// 空なら親アカウントと同じ
+	Types []string `json:"types,omitempty"`
+	// トンネル1本あたりの秒数。0なら委任トークンの期限まで
+	MaxTunnelLifetime int64 `json:"maxTunnelLifetime,omitempty"`
+	// 委任先がリクエストごとのトークンに署名する鍵
+	PublicKey string `json:"pubkey"`
+	jwt.RegisteredClaims
+}
+
+func (c *DelegationClaims) GetKeyID() string {
+	return c.KeyID
+}
+
+func (c *DelegationClaims) Validate() error {
+	if c.ExpiresAt == nil || c.IssuedAt == nil || c.ID == "" || c.PublicKey == "" {
+		return ErrNotContainRequiredClaims
+	}
+	if c.ExpiresAt.Sub(c.IssuedAt.Time) > maxDelegationLifetime {
+		return ErrDelegationLifetimeTooLong
+	}
+	for _, t := range c.Types {
+		if !slices.Contains(delegationTypes, t) {
+			return fmt.Errorf("%w: unknown type `%s`", ErrInvalidDelegation, t)
+		}
+	}
+	for _, pattern := range c.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: host pattern `%s`", ErrInvalidDelegation, pattern)
+		}
+	}
+	if c.MaxTunnelLifetime < 0 {
+		return ErrInvalidDelegation
+	}
+	return nil
+}
+
+func (c *DelegationClaims) allowsType(t string) bool {
+	return len(c.Types) == 0 || slices.Contains(c.Types, t)
+}
+
+func (c *DelegationClaims) allowsHost(host string) bool {
+	if len(c.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range c.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// トンネルを閉じる時刻
+func (c *DelegationClaims) tunnelDeadline(now time.Time) time.Time {
+	deadline := c.ExpiresAt.Time
+	if c.MaxTunnelLifetime > 0 {
+		if d := now.Add(time.Duration(c.MaxTunnelLifetime) * time.Second); d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return deadline
+}
+
+// keyは親アカウントの署名鍵。KeyID, Hosts, Types, ExpiresAtなどを埋めたcを渡す。
+// 返す文字列は委任トークンと署名用の秘密鍵をつないだもので、クライアントの設定のdelegationに書く
+func MakeDelegation(now time.Time, key interface{}, c DelegationClaims) (string, error) {
+	method, err := signingMethodForKey(key)
+	if err != nil {
+		return "", err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	c.PublicKey, err = MarshalPublicKeyString(pub)
+	if err != nil {
+		return "", err
+	}
+	c.IssuedAt = jwt.NewNumericDate(now)
+	if c.ID == "" {
+		c.ID = uuid.New().String()
+	}
+	if err := c.Validate(); err != nil {
+		return "", err
+	}
+	token, err := jwt.NewWithClaims(method, &c).SignedString(key)
+	if err != nil {
+		return "", err
+	}
+	return token + "." + base64.RawURLEncoding.EncodeToString(priv.Seed()), nil
+}
+
+// クライアント側で使う。署名は確かめない
+type Delegation struct {
+	Token  string
+	Claims DelegationClaims
+	Signer ed25519.PrivateKey
+}
+
+func ParseDelegation(s string) (*Delegation, error) {
+	i := strings.LastIndexByte(s, '.')
+	if i < 0 {
+		return nil, ErrInvalidDelegation
+	}
+	seed, err := base64.RawURLEncoding.DecodeString(s[i+1:])
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidDelegation
+	}
+	d := &Delegation{Token: s[:i], Signer: ed25519.NewKeyFromSeed(seed)}
+	if _, _, err := jwt.NewParser().ParseUnverified(d.Token, &d.Claims); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDelegation, err)
+	}
+	return d, nil
+}
+
+// 委任トークンを親アカウントの鍵で検証し、リクエストのトークンを検証する公開鍵を返す。
+// optsはリクエストのトークンと同じもの(audienceなど)
+func verifyDelegation(t string, keyID string, account *Account, now time.Time, opts ...jwt.ParserOption) (*DelegationClaims, interface{}, error) {
+	keyfunc := func(token *jwt.Token) (interface{}, error) {
+		c := token.Claims.(*DelegationClaims)
+		if c.KeyID != keyID {
+			return nil, ErrDelegationKeyIDMismatch
+		}
+		keys, err := account.keys(keyID, c.KeyVersion, now)
+		if err != nil {
+			return nil, err
+		}
+		var set jwt.VerificationKeySet
+		for _, key := range keys {
+			if methodMatchesKey(token.Method, key) {
+				set.Keys = append(set.Keys, key)
+			}
+		}
+		if len(set.Keys) == 0 {
+			return nil, ErrKeyTypeMismatch
+		}
+		return set, nil
+	}
+	var c DelegationClaims
+	opts = append(opts, jwt.WithTimeFunc(func() time.Time { return now }))
+	token, err := jwt.ParseWithClaims(t, &c, keyfunc, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("delegation: %w", err)
+	}
+	if !token.Valid {
+		return nil, nil, ErrInvalidDelegation
+	}
+	if slices.Contains(account.RevokedDelegations, c.ID) {
+		return nil, nil, ErrDelegationRevoked
+	}
+	pub, err := ParsePublicKeyString(c.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidDelegation, err)
+	}
+	return &c, pub, nil
+}
+
+// 委任トークンで制限されていればレスポンスを書いてfalseを返す
+func (rs *KishServer) allowDelegatedType(w http.ResponseWriter, claims *proxyClaims, t string) bool {
+	if claims.delegation == nil || claims.delegation.allowsType(t) {
+		return true
+	}
+	msg := fmt.Sprintf("%s tunnel is not allowed by the delegation token", strings.ToUpper(t))
+	w.Header().Set("X-Error-Message", msg)
+	w.WriteHeader(http.StatusForbidden)
+	return false
+}
+
+func (rs *KishServer) allowDelegatedHost(w http.ResponseWriter, claims *proxyClaims, host string) bool {
+	if claims.delegation == nil || claims.delegation.allowsHost(host) {
+		return true
+	}
+	w.Header().Set("X-Error-Message", "hostname is not allowed by the delegation token")
+	w.WriteHeader(http.StatusForbidden)
+	return false
+}
+
+// 委任トークンで張ったトンネルは期限が来たら閉じる。戻り値はdeferで呼ぶ
+func (c *proxyClaims) closeAtDeadline(cancel context.CancelFunc) func() bool {
+	if c.delegation == nil {
+		return func() bool { return false }
+	}
+	now := time.Now()
+	return time.AfterFunc(c.delegation.tunnelDeadline(now).Sub(now), cancel).Stop
+}
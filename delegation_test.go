@@ -0,0 +1,194 @@
+package kish
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func makeTestDelegation(t *testing.T, now time.Time, secret string, c DelegationClaims) *Delegation {
+	if c.KeyID == "" {
+		c.KeyID = "user1"
+	}
+	if c.ExpiresAt == nil {
+		c.ExpiresAt = jwt.NewNumericDate(now.Add(24 * time.Hour))
+	}
+	c.Audience = jwt.ClaimStrings{"kish.example.com"}
+	s, err := MakeDelegation(now, []byte(secret), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ParseDelegation(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestValidateTokenDelegation(t *testing.T) {
+	now := time.Now()
+	ts := &TokenSet{Accounts: map[string]*Account{
+		"user1":    {Secrets: []string{"secret1"}, RevokedDelegations: []string{"revoked-id"}},
+		"disabled": {Secrets: []string{"secret1"}, Disabled: true},
+	}}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	for _, c := range []struct {
+		name   string
+		d      *Delegation
+		keyID  string
+		signer interface{}
+		err    error
+	}{
+		{"ok", makeTestDelegation(t, now, "secret1", DelegationClaims{}), "user1", nil, nil},
+		{"wrong parent secret", makeTestDelegation(t, now, "wrong", DelegationClaims{}), "user1", nil, jwt.ErrTokenSignatureInvalid},
+		{"revoked", makeTestDelegation(t, now, "secret1", DelegationClaims{RegisteredClaims: jwt.RegisteredClaims{ID: "revoked-id"}}), "user1", nil, ErrDelegationRevoked},
+		{"expired", makeTestDelegation(t, now.Add(-48*time.Hour), "secret1", DelegationClaims{}), "user1", nil, jwt.ErrTokenExpired},
+		{"disabled parent", makeTestDelegation(t, now, "secret1", DelegationClaims{KeyID: "disabled"}), "disabled", nil, ErrAccountDisabled},
+		{"other key ID", makeTestDelegation(t, now, "secret1", DelegationClaims{KeyID: "disabled"}), "user1", nil, ErrDelegationKeyIDMismatch},
+		{"not signed by the delegated key", makeTestDelegation(t, now, "secret1", DelegationClaims{}), "user1", otherKey, jwt.ErrTokenSignatureInvalid},
+	} {
+		signer := c.signer
+		if signer == nil {
+			signer = c.d.Signer
+		}
+		token, err := GenerateToken(now, signer, c.keyID, WithDelegation(c.d.Token), WithAudience("kish.example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := validateToken(token, ts, jwt.WithAudience("kish.example.com"))
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if err == nil && (claims.delegation == nil || claims.delegation.ID != c.d.Claims.ID) {
+			t.Errorf("%s: delegation is not set", c.name)
+		}
+	}
+
+	d := makeTestDelegation(t, now, "secret1", DelegationClaims{})
+	token, _ := GenerateToken(now, d.Signer, "user1", WithDelegation(d.Token), WithAudience("kish.example.com"))
+	if _, err := validateToken(token, ts, jwt.WithAudience("other.example.com")); err == nil {
+		t.Errorf("audience is not checked")
+	}
+	// 親アカウントの鍵そのものは委任トークンの代わりにならない
+	token, _ = GenerateToken(now, []byte("secret1"), "user1", WithDelegation(d.Token))
+	if _, err := validateToken(token, ts); !errors.Is(err, ErrKeyTypeMismatch) {
+		t.Errorf("unexpected: %v", err)
+	}
+}
+
+func TestMakeDelegationInvalid(t *testing.T) {
+	now := time.Now()
+	for _, c := range []DelegationClaims{
+		{KeyID: "user1"},
+		{KeyID: "user1", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(400 * 24 * time.Hour))}},
+		{KeyID: "user1", Types: []string{"ftp"}, RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour))}},
+		{KeyID: "user1", Hosts: []string{"["}, RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour))}},
+	} {
+		if _, err := MakeDelegation(now, []byte("secret1"), c); err == nil {
+			t.Errorf("invalid delegation is made: %+v", c)
+		}
+	}
+	if _, err := ParseDelegation("a.b.c"); err == nil {
+		t.Errorf("credential without key is accepted")
+	}
+}
+
+func TestDelegationScope(t *testing.T) {
+	now := time.Now()
+	rs := &KishServer{EnableTCPForwarding: true}
+	dc := &DelegationClaims{
+		Hosts:             []string{"ci-*.kish.example.com"},
+		Types:             []string{FeatureHTTP},
+		MaxTunnelLifetime: 3600,
+		RegisteredClaims:  jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(24 * time.Hour))},
+	}
+	claims := &proxyClaims{account: &Account{Secrets: []string{"s"}}, delegation: dc}
+	for _, c := range []struct {
+		feature string
+		code    int
+	}{
+		{FeatureHTTP, 0},
+		{FeatureCustomHost, 0},
+		{FeatureTCP, http.StatusForbidden},
+		{FeatureUDP, http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		ok := rs.allowFeature(rec, claims, c.feature)
+		if ok != (c.code == 0) || (!ok && rec.Code != c.code) {
+			t.Errorf("%s: %v %d", c.feature, ok, rec.Code)
+		}
+	}
+	for host, want := range map[string]bool{
+		"ci-123.kish.example.com": true,
+		"CI-X.kish.example.com":   true,
+		"web.kish.example.com":    false,
+		"ci-1.other.example.com":  false,
+	} {
+		rec := httptest.NewRecorder()
+		if ok := rs.allowDelegatedHost(rec, claims, host); ok != want {
+			t.Errorf("%s: %v", host, ok)
+		}
+	}
+	if got := dc.tunnelDeadline(now); !got.Equal(now.Add(time.Hour)) {
+		t.Errorf("tunnelDeadline = %s", got)
+	}
+	if got := claims.responseHeader().Get("X-Kish-Key-Expires"); got != dc.ExpiresAt.UTC().Format(time.RFC3339) {
+		t.Errorf("X-Kish-Key-Expires = %q", got)
+	}
+}
+
+func TestDelegationPrivateTunnel(t *testing.T) {
+	now := time.Now()
+	rs := &KishServer{
+		Host:        "kish.example.com",
+		KeyStore:    &TokenSet{Accounts: map[string]*Account{"user1": {Secrets: []string{"secret1"}}}},
+		ReplayCache: &ReplayCache{},
+	}
+	if err := rs.Init(); err != nil {
+		t.Fatal(err)
+	}
+	rs.registerPrivateTunnel(&privateTunnel{name: "prod-db", owner: "user1"})
+	d := makeTestDelegation(t, now, "secret1", DelegationClaims{Hosts: []string{"ci-*"}, Types: []string{FeatureTCP}})
+	request := func(path string, name string) *http.Request {
+		token, err := GenerateToken(now, d.Signer, "user1", WithDelegation(d.Token), WithAudience("kish.example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(&ProxyParameters{Private: name})
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("X-Kish-HTTP", base64.StdEncoding.EncodeToString(b))
+		return r
+	}
+	// 委任トークンのhostsに合わない名前は公開も接続もできない
+	for _, c := range []struct {
+		path string
+		name string
+	}{
+		{"/proxy1", "prod-db"},
+		{"/proxy1", "other"},
+		{"/connect", "prod-db"},
+	} {
+		rec := httptest.NewRecorder()
+		if c.path == "/connect" {
+			rs.runConnect(rec, request(c.path, c.name))
+		} else {
+			claims, err := rs.authenticate(request(c.path, c.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs.runPrivateTcp(rec, request(c.path, c.name), claims, &ProxyParameters{Private: c.name})
+		}
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s: %d", c.path, c.name, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package kish
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// サーバーからトンネルの持ち主(kishクライアント)に知らせる出来事
+type TunnelEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	RemoteIP string    `json:"remoteIP,omitempty"`
+	Message  string    `json:"message"`
+	// EventAccessの場合のみ
+	Access *AccessLogEntry `json:"access,omitempty"`
+}
+
+const (
+	EventAuthLockout = "auth-lockout"
+	// ProxyParametersのAccessLogを指定したトンネルにだけ送る
+	EventAccess = "access"
+)
+
+const eventQueueSize = 64
+
+// クライアントが最初に開いたストリームにJSON Linesでイベントを流す。
+// 古いクライアントはストリームを開かないので、その場合イベントは捨てられる
+type eventSink struct {
+	ch chan TunnelEvent
+}
+
+func newEventSink() *eventSink {
+	return &eventSink{ch: make(chan TunnelEvent, eventQueueSize)}
+}
+
+// 詰まっている場合は捨てる。リクエストの処理を止めないため
+func (es *eventSink) send(ev TunnelEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	select {
+	case es.ch <- ev:
+	default:
+	}
+}
+
+func (es *eventSink) serve(session *yamux.Session) {
+	stream, err := session.Accept()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	enc := json.NewEncoder(stream)
+	for {
+		select {
+		case ev := <-es.ch:
+			if err := enc.Encode(&ev); err != nil {
+				return
+			}
+		case <-session.CloseChan():
+			return
+		}
+	}
+}
+
+// クライアント側。サーバーから届いたイベントごとにfを呼ぶ。
+// アクセスログには訪問者の送ってきた長いパスが入るので、行の長さに上限のあるbufio.Scannerは使わない
+func ReadTunnelEvents(r io.Reader, f func(TunnelEvent)) error {
+	dec := json.NewDecoder(r)
+	for {
+		var ev TunnelEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		f(ev)
+	}
+}
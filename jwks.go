@@ -0,0 +1,258 @@
+package kish
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	jwksCacheTTL       = time.Hour
+	jwksRefetchMinWait = time.Minute
+	jwksMaxSize        = 1 << 20
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwksKey struct {
+	kid string
+	key interface{}
+}
+
+// RSA, EC, OKP(Ed25519)の公開鍵だけを取り出す。対応していない鍵は無視する
+func parseJWKS(b []byte) ([]jwksKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	var keys []jwksKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			slog.Warn("JWKS: ignore key", "kid", jwk.Kid, "err", err)
+			continue
+		}
+		keys = append(keys, jwksKey{kid: jwk.Kid, key: key})
+	}
+	return keys, nil
+}
+
+func decodeB64BigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (jwk *jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeB64BigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeB64BigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeB64BigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeB64BigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("wrong key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// URLから取得したJWKSを覚えておく。知らないkidが来たら取り直す
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    []jwksKey
+	fetched time.Time
+	// 取得中ならnilでない。遅いJWKSのせいで他の訪問者が止まらないように、取得中はmuを持たない
+	fetching *jwksFetch
+}
+
+// 同時に来た訪問者は1回の取得を待つ
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// 固定のJWKS。取り直すことはない
+func newStaticJWKS(b []byte) (*jwksCache, error) {
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return nil, err
+	}
+	return &jwksCache{keys: keys, fetched: time.Now()}, nil
+}
+
+func newJWKSCache(url string, client *http.Client) *jwksCache {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &jwksCache{url: url, client: client}
+}
+
+func (c *jwksCache) fetch(ctx context.Context) ([]jwksKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(b)
+}
+
+// 訪問者のリクエストが切れても他の訪問者のために取得は続ける
+func (c *jwksCache) refresh(ctx context.Context, f *jwksFetch) {
+	keys, err := c.fetch(ctx)
+	c.mu.Lock()
+	if err == nil {
+		c.keys = keys
+		c.fetched = time.Now()
+	}
+	f.err = err
+	c.fetching = nil
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// muを取ってから呼ぶこと
+func (c *jwksCache) find(kid string) []interface{} {
+	var found []interface{}
+	for _, k := range c.keys {
+		if kid == "" || k.kid == kid {
+			found = append(found, k.key)
+		}
+	}
+	return found
+}
+
+func (c *jwksCache) lookup(ctx context.Context, kid string) ([]interface{}, error) {
+	c.mu.Lock()
+	found := c.find(kid)
+	expired := c.url != "" && time.Since(c.fetched) > jwksCacheTTL
+	// 鍵がローテーションされた可能性があるので取り直す。ただし頻繁には取りに行かない
+	rotated := len(found) == 0 && c.url != "" && time.Since(c.fetched) > jwksRefetchMinWait
+	if !expired && !rotated {
+		c.mu.Unlock()
+		return found, nil
+	}
+	f := c.fetching
+	if f == nil {
+		f = &jwksFetch{done: make(chan struct{})}
+		c.fetching = f
+		go c.refresh(context.WithoutCancel(ctx), f)
+	}
+	c.mu.Unlock()
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.find(kid), nil
+}
+
+func (c *jwksCache) keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		keys, err := c.lookup(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		var set jwt.VerificationKeySet
+		for _, key := range keys {
+			if methodMatchesKey(token.Method, key) {
+				set.Keys = append(set.Keys, key)
+			}
+		}
+		if len(set.Keys) == 0 {
+			return nil, ErrKeyNotFound
+		}
+		return set, nil
+	}
+}
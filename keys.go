@@ -0,0 +1,125 @@
+package kish
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// アカウントファイルで共有秘密鍵ではなく公開鍵を持たせるときの接頭辞
+const PublicKeyPrefix = "pubkey:"
+
+var ErrUnsupportedKeyType = errors.New("unsupported key type")
+
+func GeneratePrivateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ed25519":
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedKeyType, keyType)
+}
+
+func MarshalPrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func ParsePrivateKeyPEM(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKeyType
+	}
+	return signer, nil
+}
+
+// アカウントファイルに書く形式 "pubkey:<base64(PKIX DER)>"
+func MarshalPublicKeyString(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return PublicKeyPrefix + base64.StdEncoding.EncodeToString(der), nil
+}
+
+func ParsePublicKeyString(s string) (crypto.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, PublicKeyPrefix))
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch pub.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey, *rsa.PublicKey:
+		return pub, nil
+	}
+	return nil, ErrUnsupportedKeyType
+}
+
+func signingMethodForKey(key interface{}) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case []byte:
+		return jwt.SigningMethodHS256, nil
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	}
+	return nil, ErrUnsupportedKeyType
+}
+
+// 公開鍵をHMACの鍵として使わせるといったalgの取り違えを防ぐ
+func methodMatchesKey(method jwt.SigningMethod, key interface{}) bool {
+	var ok bool
+	switch key.(type) {
+	case []byte:
+		_, ok = method.(*jwt.SigningMethodHMAC)
+	case ed25519.PublicKey:
+		_, ok = method.(*jwt.SigningMethodEd25519)
+	case *ecdsa.PublicKey:
+		_, ok = method.(*jwt.SigningMethodECDSA)
+	case *rsa.PublicKey:
+		_, ok = method.(*jwt.SigningMethodRSA)
+		if !ok {
+			_, ok = method.(*jwt.SigningMethodRSAPSS)
+		}
+	}
+	return ok
+}
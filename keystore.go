@@ -0,0 +1,189 @@
+package kish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyIDからアカウントを引く。見つからなければnil, nilを返す。
+// TokenSet(YAMLファイル)のほか、環境変数、ディレクトリ、HTTPで引くものがある
+type KeyStore interface {
+	Lookup(keyID string) (*Account, error)
+}
+
+var ErrInvalidKeyID = errors.New("invalid key ID")
+
+// ファイル名や環境変数名に使っても問題ない文字だけを許す
+var keyIDRegexp = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9._@]*$`)
+
+func (ts *TokenSet) Lookup(keyID string) (*Account, error) {
+	return ts.Get(keyID), nil
+}
+
+// Prefix+keyIDという名前の環境変数の値を秘密鍵(か"pubkey:"で始まる公開鍵)とする
+type EnvKeyStore struct {
+	Prefix string
+}
+
+func (s *EnvKeyStore) Lookup(keyID string) (*Account, error) {
+	if !keyIDRegexp.MatchString(keyID) {
+		return nil, nil
+	}
+	v, ok := os.LookupEnv(s.Prefix + keyID)
+	if !ok || v == "" {
+		return nil, nil
+	}
+	return &Account{Secrets: []string{v}}, nil
+}
+
+// Dir/keyIDというファイルの各行を秘密鍵(か"pubkey:"で始まる公開鍵)とする。
+// 複数行書けばどれでも認証できるのでローテーションに使える
+type DirKeyStore struct {
+	Dir string
+}
+
+func (s *DirKeyStore) Lookup(keyID string) (*Account, error) {
+	if !keyIDRegexp.MatchString(keyID) {
+		return nil, nil
+	}
+	b, err := os.ReadFile(filepath.Join(s.Dir, keyID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var secrets []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			secrets = append(secrets, line)
+		}
+	}
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	return &Account{Secrets: secrets}, nil
+}
+
+const (
+	defaultHTTPKeyStoreTTL         = time.Minute
+	defaultHTTPKeyStoreNegativeTTL = 10 * time.Second
+	defaultHTTPKeyStoreTimeout     = 10 * time.Second
+	maxHTTPKeyStoreEntries         = 10000
+	maxHTTPKeyStoreResponse        = 1 << 20
+)
+
+// URLにkey_idを付けてGETし、JSONのアカウントを受け取る。404は存在しないという意味
+type HTTPKeyStore struct {
+	URL string
+	// 問い合わせ先の認証に使うヘッダーなど
+	Header http.Header
+	Client *http.Client
+	// 0ならデフォルト値
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*keyStoreEntry
+}
+
+type keyStoreEntry struct {
+	account *Account
+	expires time.Time
+}
+
+func (s *HTTPKeyStore) Lookup(keyID string) (*Account, error) {
+	if !keyIDRegexp.MatchString(keyID) {
+		return nil, nil
+	}
+	now := time.Now()
+	s.mu.Lock()
+	entry := s.cache[keyID]
+	s.mu.Unlock()
+	if entry != nil && now.Before(entry.expires) {
+		return entry.account, nil
+	}
+	account, err := s.fetch(keyID)
+	if err != nil {
+		// 問い合わせ先が落ちている間は期限切れのものでも使う
+		if entry != nil {
+			slog.Warn("HTTPKeyStore: use stale entry", "account", keyID, "err", err)
+			return entry.account, nil
+		}
+		return nil, err
+	}
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = defaultHTTPKeyStoreTTL
+	}
+	if account == nil {
+		ttl = s.NegativeTTL
+		if ttl == 0 {
+			ttl = defaultHTTPKeyStoreNegativeTTL
+		}
+	}
+	s.mu.Lock()
+	if s.cache == nil || len(s.cache) >= maxHTTPKeyStoreEntries {
+		s.cache = map[string]*keyStoreEntry{}
+	}
+	s.cache[keyID] = &keyStoreEntry{account: account, expires: now.Add(ttl)}
+	s.mu.Unlock()
+	return account, nil
+}
+
+func (s *HTTPKeyStore) fetch(keyID string) (*Account, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("key_id", keyID)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultHTTPKeyStoreTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("key lookup: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPKeyStoreResponse))
+	if err != nil {
+		return nil, err
+	}
+	var account Account
+	if err := json.Unmarshal(b, &account); err != nil {
+		return nil, fmt.Errorf("key lookup: %w", err)
+	}
+	if err := account.validate(); err != nil {
+		return nil, fmt.Errorf("key lookup: %w", err)
+	}
+	return &account, nil
+}
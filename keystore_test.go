@@ -0,0 +1,108 @@
+package kish
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEnvKeyStore(t *testing.T) {
+	t.Setenv("KISH_KEY_user1", "secret1")
+	ks := &EnvKeyStore{Prefix: "KISH_KEY_"}
+	a, err := ks.Lookup("user1")
+	if err != nil || a == nil || a.Secrets[0] != "secret1" {
+		t.Errorf("unexpected: %+v %v", a, err)
+	}
+	if a, _ := ks.Lookup("user2"); a != nil {
+		t.Errorf("unknown key is found")
+	}
+	token, _ := GenerateToken(time.Now(), []byte("secret1"), "user1")
+	if _, err := validateToken(token, ks); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDirKeyStore(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "user1"), []byte("old\nnew\n"), 0600)
+	os.WriteFile(filepath.Join(t.TempDir(), "outside"), []byte("x"), 0600)
+	ks := &DirKeyStore{Dir: dir}
+	a, err := ks.Lookup("user1")
+	if err != nil || a == nil || len(a.Secrets) != 2 {
+		t.Errorf("unexpected: %+v %v", a, err)
+	}
+	for _, keyID := range []string{"user2", "../outside", ".", ""} {
+		if a, err := ks.Lookup(keyID); a != nil || err != nil {
+			t.Errorf("%q: %+v %v", keyID, a, err)
+		}
+	}
+	token, _ := GenerateToken(time.Now(), []byte("new"), "user1")
+	if _, err := validateToken(token, ks); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHTTPKeyStore(t *testing.T) {
+	var requests atomic.Int32
+	var down atomic.Bool
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer lookup-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Query().Get("key_id") {
+		case "user1":
+			w.Write([]byte(`{"secret": "secret1", "name": "User 1", "features": ["http"]}`))
+		case "broken":
+			w.Write([]byte(`{"name": "no secret"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer stub.Close()
+
+	ks := &HTTPKeyStore{
+		URL:    stub.URL + "/keys?v=1",
+		Header: http.Header{"Authorization": {"Bearer lookup-token"}},
+		TTL:    time.Hour,
+	}
+	for range 3 {
+		a, err := ks.Lookup("user1")
+		if err != nil || a == nil || a.Secrets[0] != "secret1" || a.Name != "User 1" || a.Allows(FeatureTCP, true) {
+			t.Fatalf("unexpected: %+v %v", a, err)
+		}
+	}
+	if requests.Load() != 1 {
+		t.Errorf("result is not cached: %d requests", requests.Load())
+	}
+	for range 2 {
+		if a, err := ks.Lookup("user2"); a != nil || err != nil {
+			t.Errorf("unknown key: %+v %v", a, err)
+		}
+	}
+	if requests.Load() != 2 {
+		t.Errorf("negative result is not cached: %d requests", requests.Load())
+	}
+	if _, err := ks.Lookup("broken"); err == nil {
+		t.Errorf("account without secret is accepted")
+	}
+
+	// 期限切れでも問い合わせ先が落ちていれば前の結果を使う
+	down.Store(true)
+	ks.cache["user1"].expires = time.Now().Add(-time.Second)
+	if a, err := ks.Lookup("user1"); a == nil || err != nil {
+		t.Errorf("stale entry is not used: %+v %v", a, err)
+	}
+	if _, err := ks.Lookup("user3"); err == nil {
+		t.Errorf("error is not returned")
+	}
+}
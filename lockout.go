@@ -0,0 +1,122 @@
+package kish
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLockoutThreshold = 5
+	defaultLockoutBase      = 30 * time.Second
+	defaultLockoutMax       = time.Hour
+	maxLockoutEntries       = 10000
+)
+
+type authFailure struct {
+	failures    int
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+// 訪問者のIPごとの認証失敗回数。Threshold回失敗するとロックし、以降失敗するたびにロック時間を倍にする
+type authLimiter struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*authFailure
+}
+
+func newAuthLimiter() *authLimiter {
+	return &authLimiter{
+		Threshold: defaultLockoutThreshold,
+		Base:      defaultLockoutBase,
+		Max:       defaultLockoutMax,
+		entries:   map[string]*authFailure{},
+	}
+}
+
+// IPv6は1つのサイトに/64が割り当てられるので、/128ごとに数えると回数制限を簡単に回避できる
+func lockoutKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Unmap().Is4() {
+		return ip
+	}
+	prefix, err := addr.Prefix(64)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// ロック中なら残り時間とtrueを返す
+func (l *authLimiter) locked(ip string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[lockoutKey(ip)]
+	if !ok || !now.Before(e.lockedUntil) {
+		return 0, false
+	}
+	return e.lockedUntil.Sub(now), true
+}
+
+// 失敗を記録する。この失敗でロックされた場合はロック時間を返す
+func (l *authLimiter) fail(ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := lockoutKey(ip)
+	e, ok := l.entries[key]
+	if !ok || now.Sub(e.lastFailure) > l.Max {
+		if !ok && len(l.entries) >= maxLockoutEntries && !l.sweep(now) {
+			return 0
+		}
+		e = &authFailure{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	if e.failures < l.Threshold {
+		return 0
+	}
+	d := l.Base << min(e.failures-l.Threshold, 16)
+	if d > l.Max || d <= 0 {
+		d = l.Max
+	}
+	e.lockedUntil = now.Add(d)
+	return d
+}
+
+func (l *authLimiter) succeed(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, lockoutKey(ip))
+}
+
+// 空きができればtrueを返す。それでも溢れる場合はロックしていないものを古い順に忘れる。
+// ロック中のものは消さない。全部ロック中なら新しいIPは記録しない
+func (l *authLimiter) sweep(now time.Time) bool {
+	for key, e := range l.entries {
+		if now.Sub(e.lastFailure) > l.Max && !now.Before(e.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+	if len(l.entries) < maxLockoutEntries {
+		return true
+	}
+	var oldest string
+	for key, e := range l.entries {
+		if now.Before(e.lockedUntil) {
+			continue
+		}
+		if oldest == "" || e.lastFailure.Before(l.entries[oldest].lastFailure) {
+			oldest = key
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	delete(l.entries, oldest)
+	return true
+}
@@ -0,0 +1,84 @@
+package kish
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	now := time.Unix(10000, 0)
+	l := newAuthLimiter()
+	for i := 1; i < l.Threshold; i++ {
+		if d := l.fail("192.0.2.1", now); d != 0 {
+			t.Errorf("locked too early at %d: %s", i, d)
+		}
+	}
+	if d := l.fail("192.0.2.1", now); d != l.Base {
+		t.Errorf("lockout is unexpected: %s", d)
+	}
+	if _, locked := l.locked("192.0.2.1", now.Add(l.Base-time.Second)); !locked {
+		t.Errorf("should be locked")
+	}
+	if _, locked := l.locked("192.0.2.2", now); locked {
+		t.Errorf("other IP should not be locked")
+	}
+	// ロックが明けてまた失敗すると倍になる
+	now = now.Add(l.Base)
+	if _, locked := l.locked("192.0.2.1", now); locked {
+		t.Errorf("should be unlocked")
+	}
+	if d := l.fail("192.0.2.1", now); d != 2*l.Base {
+		t.Errorf("lockout is unexpected: %s", d)
+	}
+	for range 20 {
+		l.fail("192.0.2.1", now)
+	}
+	if d := l.fail("192.0.2.1", now); d != l.Max {
+		t.Errorf("lockout should be capped: %s", d)
+	}
+	l.succeed("192.0.2.1")
+	if _, locked := l.locked("192.0.2.1", now); locked {
+		t.Errorf("should be forgotten after success")
+	}
+}
+
+func TestAuthLimiterIPv6Prefix(t *testing.T) {
+	now := time.Unix(10000, 0)
+	l := newAuthLimiter()
+	// 同じ/64の別のアドレスから失敗しても同じ訪問者として数える
+	for i := range l.Threshold {
+		l.fail(fmt.Sprintf("2001:db8:1:2::%x", i+1), now)
+	}
+	if _, locked := l.locked("2001:db8:1:2:ffff::1", now); !locked {
+		t.Errorf("same /64 should be locked")
+	}
+	if _, locked := l.locked("2001:db8:1:3::1", now); locked {
+		t.Errorf("other /64 should not be locked")
+	}
+}
+
+func TestAuthLimiterFull(t *testing.T) {
+	now := time.Unix(10000, 0)
+	l := newAuthLimiter()
+	for range l.Threshold {
+		l.fail("192.0.2.1", now)
+	}
+	// 大量のアドレスから失敗してもロック中の訪問者は忘れない
+	for i := range maxLockoutEntries + 10 {
+		l.fail(fmt.Sprintf("2001:db8:%x::1", i), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if _, locked := l.locked("192.0.2.1", now.Add(20*time.Second)); !locked {
+		t.Errorf("locked entry is evicted")
+	}
+	if len(l.entries) > maxLockoutEntries {
+		t.Errorf("too many entries: %d", len(l.entries))
+	}
+	// 古い方から忘れる
+	if _, ok := l.entries[lockoutKey("2001:db8:0::1")]; ok {
+		t.Errorf("oldest entry is not evicted")
+	}
+	if _, ok := l.entries[lockoutKey(fmt.Sprintf("2001:db8:%x::1", maxLockoutEntries+9))]; !ok {
+		t.Errorf("newest entry is not recorded")
+	}
+}
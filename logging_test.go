@@ -0,0 +1,65 @@
+package kish
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		in    string
+		level slog.Level
+		ok    bool
+	}{
+		{"", slog.LevelInfo, true},
+		{"debug", slog.LevelDebug, true},
+		{"WARN", slog.LevelWarn, true},
+		{"error", slog.LevelError, true},
+		{"verbose", 0, false},
+	}
+	for _, tt := range tests {
+		level, err := ParseLogLevel(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err is unexpected: %+v", tt.in, err)
+			continue
+		}
+		if tt.ok && level != tt.level {
+			t.Errorf("%s: level = %s, want %s", tt.in, level, tt.level)
+		}
+	}
+}
+
+func TestNewLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewLogHandler(&buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatalf("NewLogHandler: %+v", err)
+	}
+	logger := slog.New(h).With("tunnel", "https://a.kish.example.com")
+	logger.Debug("hidden")
+	logger.Info("tunnel has been established", "account", "user1")
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("output is not a single JSON line: %s", buf.String())
+	}
+	if m["msg"] != "tunnel has been established" || m["tunnel"] != "https://a.kish.example.com" || m["account"] != "user1" {
+		t.Errorf("output is unexpected: %s", buf.String())
+	}
+
+	buf.Reset()
+	h, err = NewLogHandler(&buf, "", slog.LevelDebug)
+	if err != nil {
+		t.Fatalf("NewLogHandler: %+v", err)
+	}
+	slog.New(h).Debug("shown", "request_id", "abc")
+	if !strings.Contains(buf.String(), "msg=shown request_id=abc") {
+		t.Errorf("output is unexpected: %s", buf.String())
+	}
+
+	if _, err := NewLogHandler(&buf, "xml", slog.LevelInfo); err == nil {
+		t.Errorf("unknown format should be rejected")
+	}
+}
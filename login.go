@@ -0,0 +1,295 @@
+package kish
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	loginCookie          = "kish_login"
+	loginSessionLifetime = 24 * time.Hour
+	loginPath            = kishReservedPathPrefix + "login"
+	logoutPath           = kishReservedPathPrefix + "logout"
+	// ログインとログアウトのフォームのCSRF対策。cookieの値に署名したものをフォームに入れる
+	csrfCookie = "kish_csrf"
+)
+
+var (
+	ErrLoginFormWithoutAuth = errors.New("login form requires basic auth users")
+	ErrLoginCookieInvalid   = errors.New("login cookie is invalid")
+	ErrLoginCookieExpired   = errors.New("login cookie has expired")
+)
+
+// 認証した訪問者に渡すcookieの署名。鍵はトンネルごとに作るので、トンネルを閉じると無効になる
+type cookieSigner struct {
+	key  []byte
+	host string
+}
+
+type signedCookieValue struct {
+	User string `json:"u"`
+	Exp  int64  `json:"exp"`
+}
+
+func newCookieSigner(host string) (*cookieSigner, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &cookieSigner{key: key, host: host}, nil
+}
+
+func (s *cookieSigner) mac(payload string) []byte {
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte(s.host + "\n" + payload))
+	return m.Sum(nil)
+}
+
+func (s *cookieSigner) sign(user string, exp time.Time) (string, error) {
+	b, err := json.Marshal(&signedCookieValue{User: user, Exp: exp.Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload)), nil
+}
+
+func (s *cookieSigner) verify(value string, now time.Time) (string, error) {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", ErrLoginCookieInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.mac(payload)) {
+		return "", ErrLoginCookieInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrLoginCookieInvalid
+	}
+	var v signedCookieValue
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", ErrLoginCookieInvalid
+	}
+	if now.Unix() >= v.Exp {
+		return "", ErrLoginCookieExpired
+	}
+	return v.User, nil
+}
+
+// cookieが有効ならユーザー名を返す
+func (p *proxy2Struct) loginUser(req *http.Request) (string, bool) {
+	c, err := req.Cookie(loginCookie)
+	if err != nil {
+		return "", false
+	}
+	user, err := p.login.verify(c.Value, time.Now())
+	if err != nil {
+		return "", false
+	}
+	// cookieの発行後にユーザーが消えることはないが念のため
+	if _, exist := p.basicAuth[user]; !exist {
+		return "", false
+	}
+	return user, true
+}
+
+// フォームに入れるトークンを返す。cookieがなければ作る。ヘッダーを書く前に呼ぶこと。
+// 他のトンネルのホストから親ドメインのcookieを置かれても、トンネルごとの鍵で署名していないので通らない
+func (p *proxy2Struct) csrfToken(w http.ResponseWriter, req *http.Request) (string, error) {
+	var value string
+	if c, err := req.Cookie(csrfCookie); err == nil && c.Value != "" {
+		value = c.Value
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		value = base64.RawURLEncoding.EncodeToString(b)
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    value,
+			Path:     kishReservedPathPrefix,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	return base64.RawURLEncoding.EncodeToString(p.login.mac("csrf\n" + value)), nil
+}
+
+func (p *proxy2Struct) checkCSRF(req *http.Request) bool {
+	c, err := req.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	token, err := base64.RawURLEncoding.DecodeString(req.PostFormValue("csrf"))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(token, p.login.mac("csrf\n"+c.Value))
+}
+
+func (p *proxy2Struct) redirectToLoginForm(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := url.Values{"return_to": {req.URL.RequestURI()}}
+	http.Redirect(w, req, loginPath+"?"+q.Encode(), http.StatusFound)
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Login - {{.Host}}</title>
+</head>
+<body>
+<h1>{{.Host}}</h1>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input type="hidden" name="return_to" value="{{.ReturnTo}}">
+<p><label>Username <input type="text" name="username" value="{{.Username}}" autocomplete="username" autocapitalize="off" required autofocus></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password" required></label></p>
+<p><button type="submit">Log in</button></p>
+</form>
+</body>
+</html>
+`))
+
+// 画像タグなどでログアウトさせられないように、GETではボタンを出すだけにする
+var logoutTemplate = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Logout - {{.Host}}</title>
+</head>
+<body>
+<h1>{{.Host}}</h1>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<p><button type="submit">Log out</button></p>
+</form>
+</body>
+</html>
+`))
+
+type loginPage struct {
+	Host     string
+	Action   string
+	CSRF     string
+	ReturnTo string
+	Username string
+	Error    string
+}
+
+func (p *proxy2Struct) renderForm(w http.ResponseWriter, req *http.Request, tmpl *template.Template, status int, page loginPage) {
+	var err error
+	page.Host = p.host
+	page.CSRF, err = p.csrfToken(w, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	tmpl.Execute(w, &page)
+}
+
+func (p *proxy2Struct) renderLoginForm(w http.ResponseWriter, req *http.Request, status int, page loginPage) {
+	page.Action = loginPath
+	p.renderForm(w, req, loginTemplate, status, page)
+}
+
+func (p *proxy2Struct) loginHandler(w http.ResponseWriter, req *http.Request, remoteIP string) {
+	returnTo := safeReturnTo(req.FormValue("return_to"))
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		p.renderLoginForm(w, req, http.StatusOK, loginPage{ReturnTo: returnTo})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.checkCSRF(req) {
+		p.renderLoginForm(w, req, http.StatusForbidden, loginPage{ReturnTo: returnTo, Error: "The form has expired. Please try again"})
+		return
+	}
+	if wait, locked := p.limiter.locked(remoteIP, time.Now()); locked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many authentication failures", http.StatusTooManyRequests)
+		return
+	}
+	username := req.PostFormValue("username")
+	password, exist := p.basicAuth[username]
+	if !exist || !p.verifyPasswordCached(username, password, req.PostFormValue("password")) {
+		p.recordAuthFailure(remoteIP)
+		p.renderLoginForm(w, req, http.StatusUnauthorized, loginPage{
+			ReturnTo: returnTo,
+			Username: username,
+			Error:    "Wrong username or password",
+		})
+		return
+	}
+	p.limiter.succeed(remoteIP)
+	value, err := p.login.sign(username, time.Now().Add(loginSessionLifetime))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(loginSessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, returnTo, http.StatusSeeOther)
+}
+
+func (p *proxy2Struct) logoutHandler(w http.ResponseWriter, req *http.Request) {
+	page := loginPage{Action: logoutPath}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		p.renderForm(w, req, logoutTemplate, http.StatusOK, page)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.checkCSRF(req) {
+		page.Error = "The form has expired. Please try again"
+		p.renderForm(w, req, logoutTemplate, http.StatusForbidden, page)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, loginPath, http.StatusSeeOther)
+}
@@ -0,0 +1,180 @@
+package kish
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginCookieSigner(t *testing.T) {
+	s, err := newCookieSigner("app.kish.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	value, err := s.sign("alice", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := s.verify(value, now); err != nil || user != "alice" {
+		t.Errorf("verify failed: %s %s", user, err)
+	}
+	if _, err := s.verify(value, now.Add(2*time.Hour)); err != ErrLoginCookieExpired {
+		t.Errorf("expired cookie is accepted: %s", err)
+	}
+	// 別のトンネルの鍵では通らない
+	other, _ := newCookieSigner("app.kish.test")
+	if _, err := other.verify(value, now); err != ErrLoginCookieInvalid {
+		t.Errorf("cookie of another tunnel is accepted: %s", err)
+	}
+	payload, sig, _ := strings.Cut(value, ".")
+	forged, _ := s.sign("bob", now.Add(time.Hour))
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	for _, v := range []string{payload, forgedPayload + "." + sig, "", "." + sig} {
+		if _, err := s.verify(v, now); err != ErrLoginCookieInvalid {
+			t.Errorf("verify(%q) = %s", v, err)
+		}
+	}
+}
+
+func newLoginFormTunnel(t *testing.T) http.Handler {
+	p := &proxy2Struct{
+		host:      "app.kish.test",
+		basicAuth: map[string]string{"alice": "secret"},
+		limiter:   newAuthLimiter(),
+		events:    newEventSink(),
+	}
+	var err error
+	p.login, err = newCookieSigner(p.host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tunnelHandler(p)
+}
+
+var csrfInputRegexp = regexp.MustCompile(`name="csrf" value="([^"]+)"`)
+
+// フォームを表示してCSRFのcookieとトークンを得る
+func formCSRF(t *testing.T, h http.Handler, u string, cookies []*http.Cookie) ([]*http.Cookie, string) {
+	rec := serve(h, "GET", u, cookies)
+	m := csrfInputRegexp.FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatalf("no csrf token: %d %s", rec.Code, rec.Body.String())
+	}
+	return append(cookies, rec.Result().Cookies()...), html.UnescapeString(m[1])
+}
+
+func postForm(h http.Handler, u string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoginForm(t *testing.T) {
+	tunnel := newLoginFormTunnel(t)
+
+	rec := serve(tunnel, "GET", "http://app.kish.test/page?x=1", nil)
+	if rec.Code != http.StatusFound || rec.Header().Get("WWW-Authenticate") != "" {
+		t.Fatalf("should redirect to login page: %d", rec.Code)
+	}
+	loginURL := mustParseURL(rec.Header().Get("Location"))
+	if loginURL.Path != "/.kish/login" || loginURL.Query().Get("return_to") != "/page?x=1" {
+		t.Fatalf("unexpected redirect: %s", loginURL)
+	}
+	rec = serve(tunnel, "GET", "http://app.kish.test"+loginURL.String(), nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `value="/page?x=1"`) {
+		t.Fatalf("login page is not rendered: %d %s", rec.Code, rec.Body.String())
+	}
+
+	csrfCookies, csrf := formCSRF(t, tunnel, "http://app.kish.test/.kish/login", nil)
+
+	// CSRFトークンがなければ正しいパスワードでも通らない
+	rec = postForm(tunnel, "http://app.kish.test/.kish/login", url.Values{
+		"username": {"alice"}, "password": {"secret"}, "return_to": {"/page?x=1"},
+	}, csrfCookies)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("login without csrf token: %d", rec.Code)
+	}
+
+	rec = postForm(tunnel, "http://app.kish.test/.kish/login", url.Values{
+		"username": {"alice"}, "password": {"wrong"}, "return_to": {"/page?x=1"}, "csrf": {csrf},
+	}, csrfCookies)
+	if rec.Code != http.StatusUnauthorized || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("wrong password is accepted: %d", rec.Code)
+	}
+
+	rec = postForm(tunnel, "http://app.kish.test/.kish/login", url.Values{
+		"username": {"alice"}, "password": {"secret"}, "return_to": {"/page?x=1"}, "csrf": {csrf},
+	}, csrfCookies)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/page?x=1" {
+		t.Fatalf("login failed: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies := append(rec.Result().Cookies(), csrfCookies...)
+	req := httptest.NewRequest("GET", "http://app.kish.test/page?x=1", nil)
+	req.Header.Set("X-Forwarded-User", "mallory")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	tunnel.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "email=" {
+		t.Errorf("cookie is not accepted: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// GETやトークンなしのPOSTではログアウトしない
+	rec = serve(tunnel, "GET", "http://app.kish.test/.kish/logout", cookies)
+	if rec.Code != http.StatusOK || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("GET logs out: %d %v", rec.Code, rec.Result().Cookies())
+	}
+	rec = postForm(tunnel, "http://app.kish.test/.kish/logout", url.Values{}, cookies)
+	if rec.Code != http.StatusForbidden || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("logout without csrf token: %d %v", rec.Code, rec.Result().Cookies())
+	}
+	rec = postForm(tunnel, "http://app.kish.test/.kish/logout", url.Values{"csrf": {csrf}}, cookies)
+	cleared := rec.Result().Cookies()
+	if rec.Code != http.StatusSeeOther || len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+		t.Errorf("logout does not clear the cookie: %d %v", rec.Code, cleared)
+	}
+
+	// 他のトンネルのトークンは通らない
+	otherCookies, otherCSRF := formCSRF(t, newLoginFormTunnel(t), "http://app.kish.test/.kish/login", nil)
+	rec = postForm(tunnel, "http://app.kish.test/.kish/login", url.Values{
+		"username": {"alice"}, "password": {"secret"}, "csrf": {otherCSRF},
+	}, otherCookies)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("csrf token of another tunnel is accepted: %d", rec.Code)
+	}
+}
+
+func TestLoginFormOpenRedirect(t *testing.T) {
+	tunnel := newLoginFormTunnel(t)
+	cookies, csrf := formCSRF(t, tunnel, "http://app.kish.test/.kish/login", nil)
+	rec := postForm(tunnel, "http://app.kish.test/.kish/login", url.Values{
+		"username": {"alice"}, "password": {"secret"}, "return_to": {"//evil.example/"}, "csrf": {csrf},
+	}, cookies)
+	if rec.Header().Get("Location") != "/" {
+		t.Errorf("redirected to %s", rec.Header().Get("Location"))
+	}
+}
+
+func TestLoginFormLockout(t *testing.T) {
+	tunnel := newLoginFormTunnel(t)
+	cookies, csrf := formCSRF(t, tunnel, "http://app.kish.test/.kish/login", nil)
+	for range defaultLockoutThreshold {
+		postForm(tunnel, "http://app.kish.test/.kish/login", url.Values{"username": {"alice"}, "password": {"wrong"}, "csrf": {csrf}}, cookies)
+	}
+	rec := postForm(tunnel, "http://app.kish.test/.kish/login", url.Values{"username": {"alice"}, "password": {"secret"}, "csrf": {csrf}}, cookies)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status is unexpected: %d", rec.Code)
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 
@@ -52,10 +52,10 @@ func LogRequest(prefix string, r *http.Request, full bool) {
 		r.Body = io.NopCloser(bytes.NewReader(body))
 		logbuf := new(bytes.Buffer)
 		r.Write(logbuf)
-		log.Printf("%s%s", prefix, logbuf.String())
+		slog.Debug(strings.TrimSpace(prefix), "dump", logbuf.String())
 		r.Body = io.NopCloser(bytes.NewReader(body))
 	} else {
-		log.Printf("%s%s %s", prefix, r.Method, r.URL.String())
+		slog.Info(strings.TrimSpace(prefix), "method", r.Method, "url", r.URL.String())
 	}
 }
 
@@ -69,10 +69,10 @@ func LogResponse(prefix string, r *http.Response, full bool) {
 		if len(s) > 4096 {
 			s = s[:4096]
 		}
-		log.Printf("%s%s", prefix, s)
+		slog.Debug(strings.TrimSpace(prefix), "dump", s)
 		r.Body = io.NopCloser(bytes.NewReader(body))
 	} else {
-		log.Printf("%s%s <- %s", prefix, r.Status, r.Request.URL.String())
+		slog.Info(strings.TrimSpace(prefix), "status", r.StatusCode, "url", r.Request.URL.String())
 	}
 }
 
@@ -0,0 +1,201 @@
+package kish
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// 検証したクライアント証明書のSubjectをターゲットに知らせるヘッダー
+const clientSubjectHeader = "X-Forwarded-Client-Subject"
+
+var (
+	ErrClientCertNotEnabled = errors.New("client certificates are not requested by this server")
+	ErrInvalidClientCA      = errors.New("clientCA has no certificate")
+	ErrInvalidSubjectMatch  = errors.New("invalid subject pattern")
+	ErrClientCertRequired   = errors.New("client certificate is required")
+	ErrClientCertNotAllowed = errors.New("client certificate is not allowed")
+)
+
+type clientCertVerifier struct {
+	roots *x509.CertPool
+	// 空ならCAで検証できればよい
+	allowSubjects [][]subjectAttr
+}
+
+// Subjectの属性1つ。パターンの場合valueはpath.Matchのパターン
+type subjectAttr struct {
+	typ   string
+	value string
+}
+
+// "CN=partner-*,O=Example"のようなパターンを属性ごとに分ける。
+// "\,"のようにエスケープした区切り文字はそのまま残し、path.Matchのエスケープとして扱わせる
+func parseSubjectPattern(pattern string) ([]subjectAttr, error) {
+	var attrs []subjectAttr
+	var part strings.Builder
+	flush := func() error {
+		typ, value, ok := strings.Cut(part.String(), "=")
+		typ = strings.TrimSpace(typ)
+		if !ok || typ == "" {
+			return ErrInvalidSubjectMatch
+		}
+		if _, err := path.Match(value, ""); err != nil {
+			return ErrInvalidSubjectMatch
+		}
+		attrs = append(attrs, subjectAttr{typ: typ, value: value})
+		part.Reset()
+		return nil
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			part.WriteByte(c)
+			i++
+			part.WriteByte(pattern[i])
+		case c == ',' || c == '+':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		default:
+			part.WriteByte(c)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// Subject.String()と同じ順に、エスケープしていない値を並べる
+func subjectAttrs(name pkix.Name) []subjectAttr {
+	var attrs []subjectAttr
+	seq := name.ToRDNSequence()
+	for i := len(seq) - 1; i >= 0; i-- {
+		for _, atv := range seq[i] {
+			value, ok := atv.Value.(string)
+			if !ok {
+				continue
+			}
+			// 型の短い名前はpkixに任せる
+			typ, _, _ := strings.Cut(pkix.RDNSequence{{{Type: atv.Type, Value: ""}}}.String(), "=")
+			attrs = append(attrs, subjectAttr{typ: typ, value: value})
+		}
+	}
+	return attrs
+}
+
+// 属性の数と順序が同じで、それぞれの値がパターンに合えばtrue。
+// 区切りを含めた文字列全体で比べると*が別の属性にまで及んでしまう
+func matchSubject(pattern []subjectAttr, attrs []subjectAttr) bool {
+	if len(pattern) != len(attrs) {
+		return false
+	}
+	for i, p := range pattern {
+		if !strings.EqualFold(p.typ, attrs[i].typ) {
+			return false
+		}
+		if ok, _ := path.Match(p.value, attrs[i].value); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func newClientCertVerifier(caPEM string, allowSubjects []string) (*clientCertVerifier, error) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(caPEM)) {
+		return nil, ErrInvalidClientCA
+	}
+	v := &clientCertVerifier{roots: roots}
+	for _, pattern := range allowSubjects {
+		attrs, err := parseSubjectPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		v.allowSubjects = append(v.allowSubjects, attrs)
+	}
+	return v, nil
+}
+
+// 検証できればSubjectを返す
+func (v *clientCertVerifier) verify(state *tls.ConnectionState, now time.Time) (string, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return "", ErrClientCertRequired
+	}
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", err
+	}
+	subject := leaf.Subject.String()
+	if len(v.allowSubjects) == 0 {
+		return subject, nil
+	}
+	attrs := subjectAttrs(leaf.Subject)
+	for _, pattern := range v.allowSubjects {
+		if matchSubject(pattern, attrs) {
+			return subject, nil
+		}
+	}
+	return "", ErrClientCertNotAllowed
+}
+
+// 検証できなければレスポンスを書いてfalseを返す
+func (p *proxy2Struct) checkClientCert(w http.ResponseWriter, req *http.Request) bool {
+	req.Header.Del(clientSubjectHeader)
+	if p.clientCert == nil {
+		return true
+	}
+	subject, err := p.clientCert.verify(req.TLS, time.Now())
+	if err != nil {
+		http.Error(w, "Client certificate is required or not allowed", http.StatusForbidden)
+		return false
+	}
+	req.Header.Set(clientSubjectHeader, subject)
+	return true
+}
+
+// クライアント証明書を使うトンネルへの接続でだけ証明書を求める。
+// 他のホストでも求めるとブラウザが証明書の選択ダイアログを出してしまう
+func (rs *KishServer) tlsConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		rs.mu.Lock()
+		want := rs.clientCertHosts[strings.ToLower(hello.ServerName)]
+		rs.mu.Unlock()
+		if !want {
+			return nil, nil
+		}
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		// 検証はトンネルごとのCAで行う
+		c.ClientAuth = tls.RequestClientCert
+		// 証明書なしで始めたセッションを再開されないように
+		c.SessionTicketsDisabled = true
+		return c, nil
+	}
+}
+
+func (rs *KishServer) setClientCertHost(host string, want bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if want {
+		rs.clientCertHosts[strings.ToLower(host)] = true
+	} else {
+		delete(rs.clientCertHosts, strings.ToLower(host))
+	}
+}
@@ -0,0 +1,150 @@
+package kish
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func makeTestCert(t *testing.T, subject pkix.Name, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}))
+}
+
+func TestClientCertVerifier(t *testing.T) {
+	ca := makeTestCert(t, pkix.Name{CommonName: "Test CA"}, nil, x509.ExtKeyUsageClientAuth)
+	otherCA := makeTestCert(t, pkix.Name{CommonName: "Other CA"}, nil, x509.ExtKeyUsageClientAuth)
+	partner := makeTestCert(t, pkix.Name{CommonName: "partner-a", Organization: []string{"Example"}}, ca, x509.ExtKeyUsageClientAuth)
+	stranger := makeTestCert(t, pkix.Name{CommonName: "stranger", Organization: []string{"Example"}}, ca, x509.ExtKeyUsageClientAuth)
+	serverCert := makeTestCert(t, pkix.Name{CommonName: "partner-b", Organization: []string{"Example"}}, ca, x509.ExtKeyUsageServerAuth)
+	forged := makeTestCert(t, pkix.Name{CommonName: "partner-c", Organization: []string{"Example"}}, otherCA, x509.ExtKeyUsageClientAuth)
+	// *が属性の区切りを越えないこと
+	otherOrg := makeTestCert(t, pkix.Name{CommonName: "partner-d", Organization: []string{"Other"}}, ca, x509.ExtKeyUsageClientAuth)
+	commaCN := makeTestCert(t, pkix.Name{CommonName: "partner-e,O=Example"}, ca, x509.ExtKeyUsageClientAuth)
+
+	v, err := newClientCertVerifier(ca.pem(), []string{"CN=partner-*,O=Example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy2Struct{host: "app.kish.test", clientCert: v}
+	for name, c := range map[string]struct {
+		cert *testCert
+		code int
+	}{
+		"allowed":      {partner, http.StatusOK},
+		"no cert":      {nil, http.StatusForbidden},
+		"subject":      {stranger, http.StatusForbidden},
+		"server usage": {serverCert, http.StatusForbidden},
+		"other ca":     {forged, http.StatusForbidden},
+		"other org":    {otherOrg, http.StatusForbidden},
+		"comma in CN":  {commaCN, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "https://app.kish.test/", nil)
+		req.Header.Set(clientSubjectHeader, "CN=spoofed")
+		if c.cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.cert.cert}}
+		}
+		rec := httptest.NewRecorder()
+		ok := p.checkClientCert(rec, req)
+		if ok != (c.code == http.StatusOK) || (!ok && rec.Code != c.code) {
+			t.Errorf("%s: unexpected result %v %d", name, ok, rec.Code)
+		}
+		if ok && req.Header.Get(clientSubjectHeader) != "CN=partner-a,O=Example" {
+			t.Errorf("%s: subject is not forwarded: %s", name, req.Header.Get(clientSubjectHeader))
+		}
+	}
+
+	if _, err := newClientCertVerifier("not a pem", nil); err != ErrInvalidClientCA {
+		t.Errorf("invalid CA is accepted: %v", err)
+	}
+	for _, pattern := range []string{"CN=[", "partner", "CN=a,,O=b"} {
+		if _, err := newClientCertVerifier(ca.pem(), []string{pattern}); err != ErrInvalidSubjectMatch {
+			t.Errorf("invalid pattern %s is accepted: %v", pattern, err)
+		}
+	}
+
+	for _, c := range []struct {
+		pattern string
+		name    pkix.Name
+		want    bool
+	}{
+		{"CN=partner-*", pkix.Name{CommonName: "partner-a"}, true},
+		{"CN=partner-*", pkix.Name{CommonName: "partner-a", Organization: []string{"Other"}}, false},
+		{"cn=partner-*, O=Example", pkix.Name{CommonName: "partner-a", Organization: []string{"Example"}}, true},
+		{"CN=a\\,b", pkix.Name{CommonName: "a,b"}, true},
+		{"CN=*,O=Example", pkix.Name{CommonName: "x,O=Example"}, false},
+	} {
+		pattern, err := parseSubjectPattern(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matchSubject(pattern, subjectAttrs(c.name)); got != c.want {
+			t.Errorf("%s %s: %v", c.pattern, c.name, got)
+		}
+	}
+}
+
+func TestTLSConfigForClient(t *testing.T) {
+	rs := &KishServer{Host: "kish.test"}
+	if err := rs.Init(); err != nil {
+		t.Fatal(err)
+	}
+	f := rs.tlsConfigForClient(&tls.Config{})
+	rs.setClientCertHost("Partner.kish.test", true)
+	c, _ := f(&tls.ClientHelloInfo{ServerName: "partner.kish.test"})
+	if c == nil || c.ClientAuth != tls.RequestClientCert {
+		t.Errorf("client certificate is not requested")
+	}
+	if c, _ := f(&tls.ClientHelloInfo{ServerName: "app.kish.test"}); c != nil {
+		t.Errorf("client certificate is requested for other hosts")
+	}
+	rs.setClientCertHost("partner.kish.test", false)
+	if c, _ := f(&tls.ClientHelloInfo{ServerName: "partner.kish.test"}); c != nil {
+		t.Errorf("client certificate is requested after the tunnel is closed")
+	}
+}
@@ -0,0 +1,427 @@
+package kish
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcStateLifetime      = 10 * time.Minute
+	oidcTicketLifetime     = time.Minute
+	defaultOIDCSessionLife = 12 * time.Hour
+	oidcNonceCookie        = "kish_oidc_nonce"
+	oidcSessionCookie      = "kish_oidc"
+	// トンネル側でkishが使うパス。これ以下はターゲットに転送しない
+	kishReservedPathPrefix = "/.kish/"
+)
+
+var (
+	ErrOIDCNotConfigured = errors.New("OIDC is not configured on this server")
+	ErrOIDCNoAllowRule   = errors.New("OIDC requires allowEmails or allowGroups")
+	ErrOIDCNonceMismatch = errors.New("nonce does not match")
+	ErrOIDCEmailNotFound = errors.New("verified email is not found in ID token")
+)
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// 省略時はhttps://<KishServer.Host>/oidc/callback
+	RedirectURL string
+	// 省略時はopenid, email, profile
+	Scopes []string
+	// グループが入っているIDトークンのクレーム名。省略時はgroups
+	GroupsClaim string
+	// cookieなどの暗号化鍵(32バイト)。省略時は起動ごとに乱数で作る
+	CookieKey       []byte
+	SessionLifetime time.Duration
+	HTTPClient      *http.Client
+}
+
+// トンネルを作るときにクライアントが指定する。どちらかに一致すれば通す
+type OIDCParameters struct {
+	// "alice@example.com"のような完全一致か、"@example.com"のようなドメイン指定
+	AllowEmails []string `json:"allowEmails,omitempty"`
+	AllowGroups []string `json:"allowGroups,omitempty"`
+}
+
+func (op *OIDCParameters) validate() error {
+	if len(op.AllowEmails) == 0 && len(op.AllowGroups) == 0 {
+		return ErrOIDCNoAllowRule
+	}
+	return nil
+}
+
+func (op *OIDCParameters) allows(id *oidcIdentity) bool {
+	email := strings.ToLower(id.Email)
+	for _, rule := range op.AllowEmails {
+		rule = strings.ToLower(rule)
+		if rule == email || (strings.HasPrefix(rule, "@") && strings.HasSuffix(email, rule)) {
+			return true
+		}
+	}
+	for _, g := range op.AllowGroups {
+		if slices.Contains(id.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+type oidcIdentity struct {
+	Email  string   `json:"email"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// トンネル→/oidc/start→IdP→/oidc/callbackと持ち回る
+type oidcState struct {
+	Host     string `json:"host"`
+	ReturnTo string `json:"returnTo"`
+	Nonce    string `json:"nonce"`
+}
+
+// /oidc/callbackからトンネルに渡す。トンネル側でcookieに交換する
+type oidcTicket struct {
+	Host     string       `json:"host"`
+	ReturnTo string       `json:"returnTo"`
+	Identity oidcIdentity `json:"identity"`
+}
+
+type oidcSession struct {
+	Host     string       `json:"host"`
+	Identity oidcIdentity `json:"identity"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcProvider struct {
+	config      OIDCConfig
+	redirectURL *url.URL
+	sealer      *sealer
+	client      *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	jwks      *jwksCache
+}
+
+func newOIDCProvider(config OIDCConfig, host string) (*oidcProvider, error) {
+	if config.RedirectURL == "" {
+		config.RedirectURL = "https://" + host + "/oidc/callback"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.SessionLifetime == 0 {
+		config.SessionLifetime = defaultOIDCSessionLife
+	}
+	redirectURL, err := url.Parse(config.RedirectURL)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSealer(config.CookieKey)
+	if err != nil {
+		return nil, err
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &oidcProvider{
+		config:      config,
+		redirectURL: redirectURL,
+		sealer:      s,
+		client:      client,
+	}, nil
+}
+
+func (o *oidcProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+	u := strings.TrimSuffix(o.config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery: %s", resp.Status)
+	}
+	var d oidcDiscovery
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != o.config.Issuer {
+		return nil, fmt.Errorf("OIDC discovery: issuer mismatch: %s", d.Issuer)
+	}
+	o.discovery = &d
+	o.jwks = newJWKSCache(d.JWKSURI, o.client)
+	return o.discovery, nil
+}
+
+func (o *oidcProvider) secure() bool {
+	return o.redirectURL.Scheme == "https"
+}
+
+// コールバックと同じ階層の/start
+func (o *oidcProvider) startURL() *url.URL {
+	return o.redirectURL.ResolveReference(&url.URL{Path: "start"})
+}
+
+func (o *oidcProvider) tunnelURL(host string, path string) string {
+	return (&url.URL{Scheme: o.redirectURL.Scheme, Host: host, Path: path}).String()
+}
+
+// トンネル側: ログインしていない訪問者を/oidc/startに送る
+func (o *oidcProvider) redirectToLogin(w http.ResponseWriter, req *http.Request, host string) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	nonce, err := makeRandomStr(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state, err := o.sealer.seal("oidc-state", &oidcState{
+		Host:     host,
+		ReturnTo: req.URL.RequestURI(),
+		Nonce:    nonce,
+	}, time.Now().Add(oidcStateLifetime))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	start := o.startURL()
+	start.RawQuery = url.Values{"state": {state}}.Encode()
+	http.Redirect(w, req, start.String(), http.StatusFound)
+}
+
+// 管理ホスト側: ブラウザにnonceを覚えさせてからIdPに送る。他人のログイン結果を押し付けられないようにするため
+func (o *oidcProvider) startHandler(w http.ResponseWriter, req *http.Request) {
+	stateStr := req.URL.Query().Get("state")
+	var state oidcState
+	if err := o.sealer.open("oidc-state", stateStr, &state, time.Now()); err != nil {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	d, err := o.getDiscovery(req.Context())
+	if err != nil {
+		slog.Warn("OIDC discovery failed", "err", err)
+		http.Error(w, "OIDC provider is not available", http.StatusBadGateway)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcNonceCookie,
+		Value:    state.Nonce,
+		Path:     o.redirectURL.ResolveReference(&url.URL{Path: "."}).Path,
+		MaxAge:   int(oidcStateLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   o.secure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	authURL, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		http.Error(w, "OIDC provider is not available", http.StatusBadGateway)
+		return
+	}
+	q := authURL.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", o.config.ClientID)
+	q.Set("redirect_uri", o.config.RedirectURL)
+	q.Set("scope", strings.Join(o.config.Scopes, " "))
+	q.Set("state", stateStr)
+	q.Set("nonce", state.Nonce)
+	authURL.RawQuery = q.Encode()
+	http.Redirect(w, req, authURL.String(), http.StatusFound)
+}
+
+// 管理ホスト側: IdPから戻ってきたらIDトークンを検証し、トンネルのホストにチケットを持たせて送る
+func (o *oidcProvider) callbackHandler(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusForbidden)
+		return
+	}
+	var state oidcState
+	if err := o.sealer.open("oidc-state", q.Get("state"), &state, time.Now()); err != nil {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	c, err := req.Cookie(oidcNonceCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state.Nonce)) != 1 {
+		http.Error(w, "login session not found", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcNonceCookie,
+		Path:   o.redirectURL.ResolveReference(&url.URL{Path: "."}).Path,
+		MaxAge: -1,
+	})
+	identity, err := o.exchange(req.Context(), q.Get("code"), state.Nonce)
+	if err != nil {
+		slog.Info("OIDC login failed", "err", err)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+	ticket, err := o.sealer.seal("oidc-ticket", &oidcTicket{
+		Host:     state.Host,
+		ReturnTo: state.ReturnTo,
+		Identity: *identity,
+	}, time.Now().Add(oidcTicketLifetime))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u := o.tunnelURL(state.Host, kishReservedPathPrefix+"oidc") + "?" + url.Values{"ticket": {ticket}}.Encode()
+	http.Redirect(w, req, u, http.StatusFound)
+}
+
+func (o *oidcProvider) exchange(ctx context.Context, code string, nonce string) (*oidcIdentity, error) {
+	d, err := o.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.config.RedirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokenResp); err != nil {
+		return nil, err
+	}
+	return o.verifyIDToken(ctx, d, tokenResp.IDToken, nonce)
+}
+
+func (o *oidcProvider) verifyIDToken(ctx context.Context, d *oidcDiscovery, idToken string, nonce string) (*oidcIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, o.jwks.keyfunc(ctx),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(o.config.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, ErrOIDCNonceMismatch
+	}
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return nil, ErrOIDCEmailNotFound
+	}
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		return nil, ErrOIDCEmailNotFound
+	}
+	identity := &oidcIdentity{Email: email}
+	if groups, ok := claims[o.config.GroupsClaim].([]interface{}); ok {
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, s)
+			}
+		}
+	}
+	return identity, nil
+}
+
+// トンネル側: チケットをこのホスト用のcookieに交換する
+func (o *oidcProvider) ticketHandler(w http.ResponseWriter, req *http.Request, host string, params *OIDCParameters) {
+	var ticket oidcTicket
+	if err := o.sealer.open("oidc-ticket", req.URL.Query().Get("ticket"), &ticket, time.Now()); err != nil || ticket.Host != host {
+		http.Error(w, "invalid ticket", http.StatusBadRequest)
+		return
+	}
+	if !params.allows(&ticket.Identity) {
+		slog.Info("OIDC user is not allowed", "email", ticket.Identity.Email, "host", host)
+		http.Error(w, "You are not allowed to access this site", http.StatusForbidden)
+		return
+	}
+	session, err := o.sealer.seal("oidc-session", &oidcSession{
+		Host:     host,
+		Identity: ticket.Identity,
+	}, time.Now().Add(o.config.SessionLifetime))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(o.config.SessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   o.secure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, safeReturnTo(ticket.ReturnTo), http.StatusFound)
+}
+
+// トンネル側: cookieが有効ならその人を返す
+func (o *oidcProvider) sessionIdentity(req *http.Request, host string, params *OIDCParameters) (*oidcIdentity, bool) {
+	c, err := req.Cookie(oidcSessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	var session oidcSession
+	if err := o.sealer.open("oidc-session", c.Value, &session, time.Now()); err != nil || session.Host != host {
+		return nil, false
+	}
+	// トンネルを作り直して許可する人が変わった場合のため毎回確認する
+	if !params.allows(&session.Identity) {
+		return nil, false
+	}
+	return &session.Identity, true
+}
+
+// オープンリダイレクトにならないよう、同じホスト内のパスだけを許す
+func safeReturnTo(s string) string {
+	if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || strings.HasPrefix(s, "/\\") {
+		return "/"
+	}
+	return s
+}
@@ -0,0 +1,212 @@
+package kish
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// テスト用のIdP。/authorizeは使わず、テストがcodeとクレームを直接登録する
+type mockIssuer struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]jwt.MapClaims
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := &mockIssuer{key: key, codes: map[string]jwt.MapClaims{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 mi.URL,
+			"authorization_endpoint": mi.URL + "/authorize",
+			"token_endpoint":         mi.URL + "/token",
+			"jwks_uri":               mi.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "cid" || secret != "csecret" {
+			http.Error(w, "bad client", http.StatusUnauthorized)
+			return
+		}
+		mi.mu.Lock()
+		claims, ok := mi.codes[r.FormValue("code")]
+		mi.mu.Unlock()
+		if !ok {
+			http.Error(w, "bad code", http.StatusBadRequest)
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "k1"
+		s, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": s})
+	})
+	mi.Server = httptest.NewServer(mux)
+	t.Cleanup(mi.Close)
+	return mi
+}
+
+func (mi *mockIssuer) login(code string, email string, nonce string) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	mi.codes[code] = jwt.MapClaims{
+		"iss":            mi.URL,
+		"aud":            "cid",
+		"sub":            email,
+		"email":          email,
+		"email_verified": true,
+		"nonce":          nonce,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+func serve(h http.Handler, method string, u string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, u, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func tunnelHandler(p *proxy2Struct) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if p.handleReserved(w, req, "192.0.2.1") {
+			return
+		}
+		if p.authorize(w, req, "192.0.2.1") {
+			w.Write([]byte("email=" + req.Header.Get("X-Forwarded-Email")))
+		}
+	})
+}
+
+// 訪問者がログインを終えるまでたどり、トンネル側で最後に受け取ったレスポンスを返す
+func oidcLogin(t *testing.T, mi *mockIssuer, rs *KishServer, tunnel http.Handler, email string) *httptest.ResponseRecorder {
+	rec := serve(tunnel, "GET", "http://app.kish.test/page?x=1", nil)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("tunnel should redirect to login: %d", rec.Code)
+	}
+	rec = serve(rs, "GET", rec.Header().Get("Location"), nil)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("start should redirect to issuer: %d %s", rec.Code, rec.Body.String())
+	}
+	authURL, _ := url.Parse(rec.Header().Get("Location"))
+	if authURL.Host != mustParseURL(mi.URL).Host {
+		t.Fatalf("unexpected redirect: %s", authURL)
+	}
+	q := authURL.Query()
+	mi.login("code1", email, q.Get("nonce"))
+	callback := q.Get("redirect_uri") + "?" + url.Values{"code": {"code1"}, "state": {q.Get("state")}}.Encode()
+	rec = serve(rs, "GET", callback, rec.Result().Cookies())
+	if rec.Code != http.StatusFound {
+		t.Fatalf("callback should redirect to tunnel: %d %s", rec.Code, rec.Body.String())
+	}
+	return serve(tunnel, "GET", rec.Header().Get("Location"), nil)
+}
+
+func mustParseURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func newOIDCTestServer(t *testing.T, mi *mockIssuer) (*KishServer, http.Handler) {
+	rs := &KishServer{
+		Host: "kish.test",
+		OIDC: &OIDCConfig{
+			Issuer:       mi.URL,
+			ClientID:     "cid",
+			ClientSecret: "csecret",
+			RedirectURL:  "http://kish.test/oidc/callback",
+		},
+	}
+	if err := rs.Init(); err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy2Struct{
+		host:         "app.kish.test",
+		limiter:      newAuthLimiter(),
+		events:       newEventSink(),
+		oidc:         &OIDCParameters{AllowEmails: []string{"@example.com"}},
+		oidcProvider: rs.oidc,
+	}
+	return rs, tunnelHandler(p)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	mi := newMockIssuer(t)
+	rs, tunnel := newOIDCTestServer(t, mi)
+	rec := oidcLogin(t, mi, rs, tunnel, "alice@example.com")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/page?x=1" {
+		t.Fatalf("ticket should be exchanged for a cookie: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = serve(tunnel, "GET", "http://app.kish.test/page?x=1", rec.Result().Cookies())
+	if rec.Code != http.StatusOK || rec.Body.String() != "email=alice@example.com" {
+		t.Errorf("session cookie is not accepted: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestOIDCLoginNotAllowed(t *testing.T) {
+	mi := newMockIssuer(t)
+	rs, tunnel := newOIDCTestServer(t, mi)
+	rec := oidcLogin(t, mi, rs, tunnel, "mallory@example.org")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status is unexpected: %d", rec.Code)
+	}
+}
+
+func TestOIDCCallbackWithoutNonceCookie(t *testing.T) {
+	mi := newMockIssuer(t)
+	rs, tunnel := newOIDCTestServer(t, mi)
+	rec := serve(tunnel, "GET", "http://app.kish.test/", nil)
+	rec = serve(rs, "GET", rec.Header().Get("Location"), nil)
+	q := mustParseURL(rec.Header().Get("Location")).Query()
+	mi.login("code1", "alice@example.com", q.Get("nonce"))
+	// 別のブラウザで始めたログインの結果を押し付けられた場合
+	callback := q.Get("redirect_uri") + "?" + url.Values{"code": {"code1"}, "state": {q.Get("state")}}.Encode()
+	rec = serve(rs, "GET", callback, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status is unexpected: %d", rec.Code)
+	}
+}
+
+func TestSafeReturnTo(t *testing.T) {
+	for in, out := range map[string]string{
+		"/a?b=c":          "/a?b=c",
+		"//evil.example":  "/",
+		"/\\evil.example": "/",
+		"https://evil":    "/",
+	} {
+		if got := safeReturnTo(in); got != out {
+			t.Errorf("safeReturnTo(%q) = %q", in, got)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package kish
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// "$id$..." 形式のハッシュ。未対応のものを平文として扱うとハッシュ文字列そのものでログインできてしまうので区別する
+var passwordHashRegexp = regexp.MustCompile(`^\$[a-z0-9-]+\$`)
+
+func isPasswordHash(s string) bool {
+	return passwordHashRegexp.MatchString(s)
+}
+
+// 平文か、対応しているハッシュならtrue
+func passwordSupported(s string) bool {
+	if !isPasswordHash(s) {
+		return true
+	}
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$argon2i$", "$5$", "$6$"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 対応しているハッシュならtrue。平文は含まない。htpasswdのようにハッシュしか書かれないはずの値に使う
+func IsSupportedPasswordHash(s string) bool {
+	return isPasswordHash(s) && passwordSupported(s)
+}
+
+// ハッシュはクライアントから送られてくるので、サーバーを重くするようなパラメータは受け付けない
+const (
+	maxBcryptCost     = 14
+	maxArgon2Memory   = 64 * 1024
+	maxArgon2Time     = 16
+	maxArgon2Threads  = 16
+	maxShaCryptRounds = 1000000
+)
+
+var (
+	ErrUnsupportedPasswordHash = errors.New("unsupported password hash")
+	ErrPasswordHashTooCostly   = errors.New("password hash is too costly to verify")
+)
+
+// argon2は1回の検証でmemory(KiB)を確保するので、同時に検証する数を制限する
+const maxConcurrentArgon2 = 4
+
+var argon2Sem = make(chan struct{}, maxConcurrentArgon2)
+
+// トンネル登録時にBasicAuthの値を検査する
+func checkPasswordHash(s string) error {
+	if !passwordSupported(s) {
+		return ErrUnsupportedPasswordHash
+	}
+	switch {
+	case !isPasswordHash(s):
+		return nil
+	case strings.HasPrefix(s, "$2"):
+		cost, err := bcrypt.Cost([]byte(s))
+		if err != nil {
+			return ErrUnsupportedPasswordHash
+		}
+		if cost > maxBcryptCost {
+			return ErrPasswordHashTooCostly
+		}
+	case strings.HasPrefix(s, "$argon2"):
+		h, ok := parseArgon2(s)
+		if !ok {
+			return ErrUnsupportedPasswordHash
+		}
+		if h.memory > maxArgon2Memory || h.time > maxArgon2Time || h.threads > maxArgon2Threads {
+			return ErrPasswordHashTooCostly
+		}
+	default:
+		rounds, ok := parseShaCryptRounds(s)
+		if !ok {
+			return ErrUnsupportedPasswordHash
+		}
+		if rounds > maxShaCryptRounds {
+			return ErrPasswordHashTooCostly
+		}
+	}
+	return nil
+}
+
+// storedは平文かbcrypt, argon2, SHA-cryptのハッシュ
+func verifyPassword(stored string, input string) bool {
+	switch {
+	case !isPasswordHash(stored):
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(input)) == 1
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(input)) == nil
+	case strings.HasPrefix(stored, "$argon2"):
+		return verifyArgon2(stored, input)
+	case strings.HasPrefix(stored, "$5$"), strings.HasPrefix(stored, "$6$"):
+		computed, err := shaCrypt(stored, input)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(computed)) == 1
+	}
+	return false
+}
+
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	hash    []byte
+}
+
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+// tやpが0だとargon2がpanicし、hashが空だとどんなパスワードでも一致してしまうので受け付けない
+func parseArgon2(stored string) (*argon2Hash, bool) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 || (parts[1] != "argon2id" && parts[1] != "argon2i") {
+		return nil, false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, false
+	}
+	h := &argon2Hash{variant: parts[1]}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, false
+	}
+	if h.time < 1 || h.threads < 1 {
+		return nil, false
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(h.salt) == 0 {
+		return nil, false
+	}
+	if h.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.hash) == 0 {
+		return nil, false
+	}
+	return h, true
+}
+
+func verifyArgon2(stored string, input string) bool {
+	h, ok := parseArgon2(stored)
+	if !ok {
+		return false
+	}
+	argon2Sem <- struct{}{}
+	defer func() { <-argon2Sem }()
+	var computed []byte
+	if h.variant == "argon2id" {
+		computed = argon2.IDKey([]byte(input), h.salt, h.time, h.memory, h.threads, uint32(len(h.hash)))
+	} else {
+		computed = argon2.Key([]byte(input), h.salt, h.time, h.memory, h.threads, uint32(len(h.hash)))
+	}
+	return subtle.ConstantTimeCompare(h.hash, computed) == 1
+}
+
+const (
+	shaCryptRoundsDefault = 5000
+	shaCryptRoundsMin     = 1000
+	shaCryptRoundsMax     = 999999999
+	shaCryptSaltMax       = 16
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// Ulrich DrepperのSHA-crypt ($5$, $6$)。storedからsaltとroundsを取り出して同じ形式のハッシュを作る
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+func shaCrypt(stored string, password string) (string, error) {
+	var newHash func() hash.Hash
+	var prefix string
+	var order [][3]int
+	switch {
+	case strings.HasPrefix(stored, "$5$"):
+		newHash, prefix = sha256.New, "$5$"
+		order = [][3]int{{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+			{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29}}
+	case strings.HasPrefix(stored, "$6$"):
+		newHash, prefix = sha512.New, "$6$"
+		order = [][3]int{{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+			{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10},
+			{53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35}, {15, 36, 57}, {37, 58, 16},
+			{59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41}}
+	default:
+		return "", ErrUnsupportedPasswordHash
+	}
+
+	rounds, ok := parseShaCryptRounds(stored)
+	if !ok {
+		return "", ErrUnsupportedPasswordHash
+	}
+	rest := stored[len(prefix):]
+	roundsSpecified := strings.HasPrefix(rest, "rounds=")
+	if roundsSpecified {
+		_, rest, _ = strings.Cut(rest, "$")
+	}
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > shaCryptSaltMax {
+		salt = salt[:shaCryptSaltMax]
+	}
+	p := []byte(password)
+	s := []byte(salt)
+
+	h := newHash()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+	size := len(b)
+
+	h = newHash()
+	h.Write(p)
+	h.Write(s)
+	i := len(p)
+	for ; i > size; i -= size {
+		h.Write(b)
+	}
+	h.Write(b[:i])
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h = newHash()
+	for range len(p) {
+		h.Write(p)
+	}
+	pSeq := repeatToLength(h.Sum(nil), len(p))
+
+	h = newHash()
+	for range 16 + int(a[0]) {
+		h.Write(s)
+	}
+	sSeq := repeatToLength(h.Sum(nil), len(s))
+
+	c := a
+	for r := range rounds {
+		h = newHash()
+		if r&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(c)
+		}
+		if r%3 != 0 {
+			h.Write(sSeq)
+		}
+		if r%7 != 0 {
+			h.Write(pSeq)
+		}
+		if r&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pSeq)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(prefix)
+	if roundsSpecified {
+		fmt.Fprintf(&out, "rounds=%d$", rounds)
+	}
+	out.WriteString(salt)
+	out.WriteString("$")
+	for _, o := range order {
+		cryptB64(&out, c[o[0]], c[o[1]], c[o[2]], 4)
+	}
+	// 3バイト単位で割り切れない残り
+	if size == sha256.Size {
+		cryptB64(&out, 0, c[31], c[30], 3)
+	} else {
+		cryptB64(&out, 0, 0, c[63], 2)
+	}
+	return out.String(), nil
+}
+
+func parseShaCryptRounds(stored string) (int, bool) {
+	rest := stored[3:]
+	if !strings.HasPrefix(rest, "rounds=") {
+		return shaCryptRoundsDefault, true
+	}
+	r, _, ok := strings.Cut(strings.TrimPrefix(rest, "rounds="), "$")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(r)
+	if err != nil {
+		return 0, false
+	}
+	return min(max(n, shaCryptRoundsMin), shaCryptRoundsMax), true
+}
+
+func repeatToLength(b []byte, length int) []byte {
+	out := make([]byte, 0, length)
+	for len(out) < length {
+		out = append(out, b[:min(len(b), length-len(out))]...)
+	}
+	return out
+}
+
+func cryptB64(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for range n {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -4,15 +4,19 @@ import (
 	"bufio"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/hashicorp/yamux"
@@ -23,6 +27,22 @@ type ProxyParameters struct {
 	AllowIP   []string          `json:"allowIP"`
 	BasicAuth map[string]string `json:"basicAuth"`
 	AllowMyIP bool              `json:"allowMyIP"`
+	// BasicAuthの資格情報を、ブラウザのダイアログではなくkishのログインページで入力させる
+	LoginForm bool `json:"loginForm,omitempty"`
+	// Authorization: Bearerで受け付ける値。BasicAuthと同じくハッシュでもよい
+	APIKeys   []string       `json:"apiKeys,omitempty"`
+	TokenAuth []TokenAuth    `json:"tokenAuth,omitempty"`
+	JWT       *JWTParameters `json:"jwt,omitempty"`
+	// PEMのCA証明書。指定すると訪問者にクライアント証明書を要求する
+	ClientCA      string   `json:"clientCA,omitempty"`
+	AllowSubjects []string `json:"allowSubjects,omitempty"`
+	// サーバーでOIDCが設定されている場合のみ使える
+	OIDC *OIDCParameters `json:"oidc,omitempty"`
+	// 以下はTCPのプライベートトンネル用
+	Private       string   `json:"private,omitempty"`
+	AllowAccounts []string `json:"allowAccounts,omitempty"`
+	// trueならHTTPトンネルのアクセスログをイベントとしてクライアントに送る
+	AccessLog bool `json:"accessLog,omitempty"`
 }
 
 type proxy2Struct struct {
@@ -30,8 +50,38 @@ type proxy2Struct struct {
 	ipset     IPSet
 	trustXFF  bool
 	basicAuth map[string]string
+	// bcryptなどは重いので、一度通った組み合わせを覚えておく
+	verifiedMu sync.Mutex
+	verified   map[[32]byte]bool
+	limiter    *authLimiter
+	events     *eventSink
+	apiKeys    []string
+	tokenAuth  []TokenAuth
+	jwt        *visitorJWT
+	clientCert *clientCertVerifier
+	// LoginFormが指定された場合のみ
+	login *cookieSigner
+	// 共有リンクの署名鍵はクライアントにも渡す。cookieの鍵はサーバーだけが持つ
+	shareKey    []byte
+	shareCookie *cookieSigner
+
+	oidc         *OIDCParameters
+	oidcProvider *oidcProvider
 
 	session *yamux.Session
+
+	// ロックアウトを監査ログに書くため
+	keyID string
+	audit *AuditLog
+
+	logger *slog.Logger
+
+	// nilならファイルには書かない
+	accessLog       *AuditLog
+	accessLogFormat string
+	streamAccessLog bool
+	// accessLogを閉じる前に処理中のリクエストを待つ
+	inflight sync.WaitGroup
 }
 
 func makeRandomStr(length int) (string, error) {
@@ -63,94 +113,165 @@ func (rs *KishServer) runHttp(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	t := extractBearerToken(r.Header.Get("Authorization"))
-	if err := validateToken(t, rs.TokenSet); err != nil {
-		log.Printf("validateToken failed: %+v", err)
+	claims, err := rs.authenticate(r)
+	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Unauthorized"))
 		cancel()
 		return
 	}
+	if !rs.allowFeature(w, claims, FeatureHTTP) {
+		return
+	}
 
-	bt, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Kish-HTTP"))
+	params, err := parseProxyParameters(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	var params ProxyParameters
-	err = json.Unmarshal(bt, &params)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if params.Host != "" && !rs.allowFeature(w, claims, FeatureCustomHost) {
 		return
 	}
 
 	proxy2 := proxy2Struct{
 		trustXFF: rs.TrustXFF,
+		limiter:  newAuthLimiter(),
+		events:   newEventSink(),
+		keyID:    claims.KeyID,
+		audit:    rs.AuditLog,
 	}
 
 	proxy2.basicAuth = map[string]string{}
 	for user, pass := range params.BasicAuth {
+		// 値そのものはログにもレスポンスにも出さない
+		if err := checkPasswordHash(pass); err != nil {
+			w.Header().Set("X-Error-Message", fmt.Sprintf("password of %s: %s", user, err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		proxy2.basicAuth[user] = pass
 	}
 
-	remoteIP := GetRemoteIP(r, rs.TrustXFF)
+	for i, key := range params.APIKeys {
+		if err := validateAPIKey(key); err != nil {
+			w.Header().Set("X-Error-Message", fmt.Sprintf("api key #%d: %s", i+1, err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	proxy2.apiKeys = params.APIKeys
+	for i := range params.TokenAuth {
+		if err := params.TokenAuth[i].validate(); err != nil {
+			w.Header().Set("X-Error-Message", fmt.Sprintf("token auth #%d: %s", i+1, err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	proxy2.tokenAuth = params.TokenAuth
 
-	if params.Host == "" {
-		ngorkishDN, err := makeNgrokishDomainName(remoteIP, rs.ProxyDomainSuffix)
+	if params.JWT != nil {
+		err := params.JWT.validate()
+		if err == nil && params.JWT.JWKSURL != "" && !jwksURLAllowed(params.JWT.JWKSURL, rs.AllowJWKSURLs) {
+			err = ErrJWKSURLNotAllowed
+		}
+		var keys *jwksCache
+		if err == nil {
+			keys, err = params.JWT.newKeySet(nil)
+		}
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			w.Header().Set("X-Error-Message", fmt.Sprintf("jwt: %s", err))
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		proxy2.host = ngorkishDN
-	} else {
-		if !strings.HasSuffix(params.Host, rs.ProxyDomainSuffix) {
-			w.Header().Set("X-Error-Message", "wrong domain name")
+		proxy2.jwt = &visitorJWT{params: params.JWT, keys: keys}
+	}
+
+	if params.ClientCA != "" {
+		var err error
+		proxy2.clientCert, err = newClientCertVerifier(params.ClientCA, params.AllowSubjects)
+		if err == nil && !rs.RequestClientCert {
+			err = ErrClientCertNotEnabled
+		}
+		if err != nil {
+			w.Header().Set("X-Error-Message", err.Error())
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		// 使えない文字が入ってないかチェック
-		dc := strings.TrimSuffix(params.Host, rs.ProxyDomainSuffix)
-		if matched, _ := regexp.MatchString("^[a-z0-9][-a-z0-9]*$", strings.ToLower(dc)); !matched {
-			w.Header().Set("X-Error-Message", "wrong domain name")
+	}
+
+	if params.LoginForm && len(proxy2.basicAuth) == 0 {
+		w.Header().Set("X-Error-Message", ErrLoginFormWithoutAuth.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if params.OIDC != nil {
+		err := params.OIDC.validate()
+		if rs.oidc == nil {
+			err = ErrOIDCNotConfigured
+		}
+		if err != nil {
+			w.Header().Set("X-Error-Message", err.Error())
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		proxy2.host = params.Host
+		proxy2.oidc = params.OIDC
+		proxy2.oidcProvider = rs.oidc
 	}
-	// hostが既に使われていないかチェック
-	// ランダム生成の場合はやり直せるがめんどうなのでそのままエラーにしている
-	if rs.isOccupied(proxy2.host) {
-		log.Printf("host %s is occupied", proxy2.host)
-		w.Header().Set("X-Error-Message", "domain name is already in use")
-		w.WriteHeader(http.StatusConflict)
+
+	remoteIP := GetRemoteIP(r, rs.TrustXFF)
+
+	host, ok := rs.decideHost(w, params, remoteIP)
+	if !ok || !rs.allowDelegatedHost(w, claims, host) {
 		return
 	}
-
-	for _, cidr := range params.AllowIP {
-		proxy2.ipset.Add(cidr)
+	defer claims.closeAtDeadline(cancel)()
+	proxy2.host = host
+	proxy2.ipset = makeAllowIPSet(params, remoteIP)
+	proxy2.logger = claims.logger().With("tunnel", "https://"+host)
+	proxy2.accessLog = rs.AccessLog.open(host)
+	go rs.AccessLog.maybeRemoveOld(time.Now(), rs.ProxyDomainSuffix, rs.hostRegistered)
+	defer func() {
+		proxy2.inflight.Wait()
+		proxy2.accessLog.Close()
+	}()
+	if rs.AccessLog != nil {
+		proxy2.accessLogFormat = rs.AccessLog.Format
 	}
-	if params.AllowMyIP {
-		if strings.Contains(remoteIP, ":") {
-			// 多分IPv6
-			proxy2.ipset.Add(remoteIP + "/128")
-		} else {
-			proxy2.ipset.Add(remoteIP + "/32")
+	proxy2.streamAccessLog = params.AccessLog
+	if params.LoginForm {
+		proxy2.login, err = newCookieSigner(host)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 	}
+	proxy2.shareKey, err = newShareKey()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	proxy2.shareCookie, err = newCookieSigner(host)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	respHeader := http.Header{}
+	respHeader := claims.responseHeader()
 	respHeader.Set("X-Kish-URL", "https://"+proxy2.host)
 	respHeader.Set("X-Kish-Allow-IP", proxy2.ipset.String())
+	respHeader.Set("X-Kish-Share-Key", base64.StdEncoding.EncodeToString(proxy2.shareKey))
 	c, err := websocketUpgrader.Upgrade(w, r, respHeader)
 	if err != nil {
-		log.Print("upgrade:", err)
+		proxy2.logger.Warn("websocket upgrade failed", "err", err)
 		return
 	}
 	defer c.Close()
 
-	proxy2.session, err = yamux.Server(MakeRWC(c), nil)
+	rwc := newCountingRWC(MakeRWC(c))
+	proxy2.session, err = yamux.Server(rwc, nil)
 	if err != nil {
-		log.Printf("yamux.Server: %s", err)
+		proxy2.logger.Error("yamux.Server failed", "err", err)
 		return
 	}
 	go func() {
@@ -158,20 +279,92 @@ func (rs *KishServer) runHttp(w http.ResponseWriter, r *http.Request) {
 		cancel()
 	}()
 	defer proxy2.session.Close()
+	go proxy2.events.serve(proxy2.session)
 
 	// isOccupiedでチェックされてからここに至る間に同じhostが取得されている可能性がある。
 	// レスポンスはupgradeで既に送出済みなのでエラーを返すことはできず接続を切るしかない。
 	// レアケースなのでそれでよしとする。対処するとしたら、予約してから確定という方式は可能そう
 	err = rs.AddHostRouter(proxy2.host, func(sr *mux.Router) { sr.PathPrefix("/").HandlerFunc(proxy2.normalHandler) })
 	if err != nil {
-		log.Printf("AddHostRouter: %s", err)
+		proxy2.logger.Warn("AddHostRouter failed", "err", err)
 		return
 	}
 	defer rs.DeleteHostRouter(proxy2.host)
-	log.Printf("tunnel for %s has been established", proxy2.host)
+	if proxy2.clientCert != nil {
+		rs.setClientCertHost(proxy2.host, true)
+		defer rs.setClientCertHost(proxy2.host, false)
+	}
+	proxy2.logger.Info("tunnel has been established")
+	defer proxy2.logger.Info("tunnel has been closed")
+	defer rs.auditTunnel(r, claims, params, AuditEvent{Type: FeatureHTTP, Host: proxy2.host}, rwc)()
 	<-ctx.Done()
 }
 
+func parseProxyParameters(r *http.Request) (*ProxyParameters, error) {
+	bt, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Kish-HTTP"))
+	if err != nil {
+		return nil, err
+	}
+	var params ProxyParameters
+	err = json.Unmarshal(bt, &params)
+	if err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+// 使用するホスト名を決める。失敗した場合はレスポンスを書いてfalseを返す
+func (rs *KishServer) decideHost(w http.ResponseWriter, params *ProxyParameters, remoteIP string) (string, bool) {
+	var host string
+	if params.Host == "" {
+		ngorkishDN, err := makeNgrokishDomainName(remoteIP, rs.ProxyDomainSuffix)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return "", false
+		}
+		host = ngorkishDN
+	} else {
+		if !strings.HasSuffix(params.Host, rs.ProxyDomainSuffix) {
+			w.Header().Set("X-Error-Message", "wrong domain name")
+			w.WriteHeader(http.StatusBadRequest)
+			return "", false
+		}
+		// 使えない文字が入ってないかチェック
+		dc := strings.TrimSuffix(params.Host, rs.ProxyDomainSuffix)
+		if matched, _ := regexp.MatchString("^[a-z0-9][-a-z0-9]*$", strings.ToLower(dc)); !matched {
+			w.Header().Set("X-Error-Message", "wrong domain name")
+			w.WriteHeader(http.StatusBadRequest)
+			return "", false
+		}
+		host = params.Host
+	}
+	// hostが既に使われていないかチェック
+	// ランダム生成の場合はやり直せるがめんどうなのでそのままエラーにしている
+	if rs.isOccupied(host) {
+		slog.Info("host is occupied", "host", host)
+		w.Header().Set("X-Error-Message", "domain name is already in use")
+		w.WriteHeader(http.StatusConflict)
+		return "", false
+	}
+	return host, true
+}
+
+func makeAllowIPSet(params *ProxyParameters, remoteIP string) IPSet {
+	var ipset IPSet
+	for _, cidr := range params.AllowIP {
+		ipset.Add(cidr)
+	}
+	if params.AllowMyIP {
+		if strings.Contains(remoteIP, ":") {
+			// 多分IPv6
+			ipset.Add(remoteIP + "/128")
+		} else {
+			ipset.Add(remoteIP + "/32")
+		}
+	}
+	return ipset
+}
+
 func GetRemoteIP(req *http.Request, trustXFF bool) string {
 	if trustXFF {
 		xff := req.Header.Get("X-Forwarded-For")
@@ -206,23 +399,90 @@ func (p *proxy2Struct) checkAuth(req *http.Request) bool {
 	if !exist {
 		return false
 	}
-	return password == passwordIn
+	return p.verifyPasswordCached(usernameIn, password, passwordIn)
+}
+
+const maxVerifiedCacheSize = 1000
+
+func (p *proxy2Struct) verifyPasswordCached(username string, stored string, input string) bool {
+	if !isPasswordHash(stored) {
+		return verifyPassword(stored, input)
+	}
+	key := sha256.Sum256([]byte(username + "\x00" + stored + "\x00" + input))
+	p.verifiedMu.Lock()
+	ok := p.verified[key]
+	p.verifiedMu.Unlock()
+	if ok {
+		return true
+	}
+	if !verifyPassword(stored, input) {
+		return false
+	}
+	p.verifiedMu.Lock()
+	if p.verified == nil || len(p.verified) >= maxVerifiedCacheSize {
+		p.verified = map[[32]byte]bool{}
+	}
+	p.verified[key] = true
+	p.verifiedMu.Unlock()
+	return true
+}
+
+func (p *proxy2Struct) recordAuthFailure(remoteIP string) {
+	d := p.limiter.fail(remoteIP, time.Now())
+	if d == 0 {
+		return
+	}
+	msg := fmt.Sprintf("%s has been locked out for %s after repeated authentication failures", remoteIP, d)
+	p.log().Warn("visitor has been locked out", "remote_ip", remoteIP, "duration", d)
+	p.audit.Write(AuditEvent{
+		Event:    AuditLockout,
+		KeyID:    p.keyID,
+		Type:     FeatureHTTP,
+		Host:     p.host,
+		RemoteIP: remoteIP,
+		Duration: d.Seconds(),
+	})
+	p.events.send(TunnelEvent{
+		Type:     EventAuthLockout,
+		RemoteIP: remoteIP,
+		Message:  msg,
+	})
+}
+
+// テストなどでloggerを設定していなければデフォルト
+func (p *proxy2Struct) log() *slog.Logger {
+	if p.logger == nil {
+		return slog.Default()
+	}
+	return p.logger
 }
 
 func (p *proxy2Struct) normalHandler(w http.ResponseWriter, req *http.Request) {
-	log.Printf("new connection to %s", p.host)
-	log.Printf("Host: %s", req.Host)
+	p.inflight.Add(1)
+	defer p.inflight.Done()
+	logger := p.log().With("request_id", newRequestID())
+	logger.Debug("new request", "method", req.Method, "host", req.Host, "path", req.URL.Path)
+	start := time.Now()
+	aw := &accessLogWriter{ResponseWriter: w}
+	w = aw
 	w.Header().Set("X-Robots-Tag", "none")
 	remoteIP, okIP := p.checkRemoteIP(req)
+	var user string
+	defer func() { p.logAccess(req, aw, remoteIP, user, start) }()
 	if !okIP {
 		http.Error(w, "Access form your IP is not allowed", http.StatusForbidden)
 		return
 	}
-	if !p.checkAuth(req) {
-		w.Header().Set("WWW-Authenticate", "Basic")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !p.checkClientCert(w, req) {
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, kishReservedPathPrefix) && p.handleReserved(w, req, remoteIP) {
+		return
+	}
+	if !p.authorize(w, req, remoteIP) {
 		return
 	}
+	user = p.visitorUser(req)
 	serverConn, err := p.session.Open()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
@@ -233,26 +493,26 @@ func (p *proxy2Struct) normalHandler(w http.ResponseWriter, req *http.Request) {
 	req.Header.Set("X-Forwarded-Proto", "https")
 
 	if err = req.Write(serverConn); err != nil {
-		log.Printf("error req.Write: %s", err)
+		logger.Warn("req.Write failed", "err", err)
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 	serverBufR := bufio.NewReader(serverConn)
 	resp, err := http.ReadResponse(serverBufR, req)
 	if err != nil {
-		log.Printf("error ReadResponse: %s", err)
+		logger.Warn("ReadResponse failed", "err", err)
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 
 	if _, err = writeResponse(resp, w); err != nil {
-		log.Printf("responseToResponseWriter: %s", err)
+		logger.Debug("writeResponse failed", "err", err)
 		return
 	}
-	log.Printf("resp Connection:%s", resp.Header.Get("Connection"))
+	logger.Debug("response", "status", resp.StatusCode, "connection", resp.Header.Get("Connection"))
 
 	if IsWebsocket(req) && resp.StatusCode == 101 {
-		hijackToWebsocket(w, serverConn)
+		hijackToWebsocket(w, serverConn, logger)
 	}
 }
 
@@ -271,7 +531,7 @@ func IsWebsocket(req *http.Request) bool {
 	return r
 }
 
-func hijackToWebsocket(w http.ResponseWriter, serverConn io.ReadWriteCloser) {
+func hijackToWebsocket(w http.ResponseWriter, serverConn io.ReadWriteCloser, logger *slog.Logger) {
 	defer serverConn.Close()
 	hj, ok := w.(http.Hijacker)
 	if !ok {
@@ -285,11 +545,11 @@ func hijackToWebsocket(w http.ResponseWriter, serverConn io.ReadWriteCloser) {
 	}
 	defer conn.Close()
 	if bufRW.Writer.Buffered() > 0 {
-		log.Printf("bufRW unexpectedly has buffered data")
+		logger.Warn("bufRW unexpectedly has buffered data")
 		// TODO: return HTTP response
 		return
 	}
-	log.Printf("start websocket passthrough")
+	logger.Debug("start websocket passthrough")
 	Passthrough(conn, serverConn)
 }
 
@@ -0,0 +1,193 @@
+package kish
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+
+	"github.com/hashicorp/yamux"
+)
+
+var privateNameRegexp = regexp.MustCompile("^[a-z0-9][-a-z0-9]*$")
+
+// 公開ポートを持たず、kish connectからのみ到達できるトンネル
+type privateTunnel struct {
+	name          string
+	owner         string
+	allowAccounts []string
+
+	session *yamux.Session
+}
+
+func (pt *privateTunnel) isAllowed(keyID string) bool {
+	return keyID == pt.owner || slices.Contains(pt.allowAccounts, keyID) || slices.Contains(pt.allowAccounts, "*")
+}
+
+func (rs *KishServer) registerPrivateTunnel(pt *privateTunnel) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if _, ok := rs.privateTunnels[pt.name]; ok {
+		return errors.New("occupied")
+	}
+	rs.privateTunnels[pt.name] = pt
+	return nil
+}
+
+func (rs *KishServer) unregisterPrivateTunnel(pt *privateTunnel) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.privateTunnels[pt.name] == pt {
+		delete(rs.privateTunnels, pt.name)
+	}
+}
+
+func (rs *KishServer) lookupPrivateTunnel(name string) *privateTunnel {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.privateTunnels[name]
+}
+
+// runTcpから呼ばれる。トークンの検証は済んでいる前提
+func (rs *KishServer) runPrivateTcp(w http.ResponseWriter, r *http.Request, claims *proxyClaims, params *ProxyParameters) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer claims.closeAtDeadline(cancel)()
+
+	if !privateNameRegexp.MatchString(params.Private) {
+		w.Header().Set("X-Error-Message", "wrong tunnel name")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// 委任トークンのhostsはプライベートトンネルの名前にも適用する
+	if !rs.allowDelegatedHost(w, claims, params.Private) {
+		return
+	}
+	if rs.lookupPrivateTunnel(params.Private) != nil {
+		w.Header().Set("X-Error-Message", "tunnel name is already in use")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	logger := claims.logger().With("tunnel", "private://"+params.Private)
+	respHeader := claims.responseHeader()
+	respHeader.Set("X-Kish-URL", "private://"+params.Private)
+	c, err := websocketUpgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		logger.Warn("websocket upgrade failed", "err", err)
+		return
+	}
+	defer c.Close()
+
+	rwc := newCountingRWC(MakeRWC(c))
+	session, err := yamux.Server(rwc, nil)
+	if err != nil {
+		logger.Error("yamux.Server failed", "err", err)
+		return
+	}
+	defer session.Close()
+	go func() {
+		<-session.CloseChan()
+		cancel()
+	}()
+
+	pt := &privateTunnel{
+		name:          params.Private,
+		owner:         claims.KeyID,
+		allowAccounts: params.AllowAccounts,
+		session:       session,
+	}
+	// runHttpと同様、チェックからここまでの間に取られていたら切断するしかない
+	if err := rs.registerPrivateTunnel(pt); err != nil {
+		logger.Warn("registerPrivateTunnel failed", "err", err)
+		return
+	}
+	defer rs.unregisterPrivateTunnel(pt)
+	logger.Info("tunnel has been established")
+	defer logger.Info("tunnel has been closed")
+	defer rs.auditTunnel(r, claims, params, AuditEvent{Type: "private", Host: pt.name}, rwc)()
+	<-ctx.Done()
+}
+
+func (rs *KishServer) runConnect(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	claims, err := rs.authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	params, err := parseProxyParameters(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !rs.allowDelegatedType(w, claims, FeatureTCP) || !rs.allowDelegatedHost(w, claims, params.Private) {
+		return
+	}
+	defer claims.closeAtDeadline(cancel)()
+	logger := claims.logger().With("tunnel", "private://"+params.Private)
+	pt := rs.lookupPrivateTunnel(params.Private)
+	// 存在しないのか権限がないのかは区別させない
+	if pt == nil || !pt.isAllowed(claims.KeyID) {
+		logger.Info("connection to private tunnel is not allowed")
+		w.Header().Set("X-Error-Message", "no such private tunnel")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	c, err := websocketUpgrader.Upgrade(w, r, claims.responseHeader())
+	if err != nil {
+		logger.Warn("websocket upgrade failed", "err", err)
+		return
+	}
+	defer c.Close()
+
+	// kish connect側がストリームを開く
+	rwc := newCountingRWC(MakeRWC(c))
+	session, err := yamux.Server(rwc, nil)
+	if err != nil {
+		logger.Error("yamux.Server failed", "err", err)
+		return
+	}
+	defer session.Close()
+	go func() {
+		select {
+		case <-session.CloseChan():
+		case <-pt.session.CloseChan():
+		}
+		cancel()
+	}()
+	go forwardFromYamuxSessionToYamuxSession(session, pt.session, logger)
+	logger.Info("connected to private tunnel")
+	defer logger.Info("disconnected from private tunnel")
+	defer rs.auditTunnel(r, claims, nil, AuditEvent{Type: "connect", Host: pt.name}, rwc)()
+	<-ctx.Done()
+}
+
+func forwardFromYamuxSessionToYamuxSession(from *yamux.Session, to *yamux.Session, logger *slog.Logger) {
+	for {
+		clientConn, err := from.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer clientConn.Close()
+			serverConn, err := to.Open()
+			if err != nil {
+				logger.Warn("session.Open failed", "err", err)
+				return
+			}
+			defer serverConn.Close()
+			err = Passthrough(clientConn, serverConn)
+			if err != nil {
+				logger.Debug("Passthrough ended with error", "err", err)
+				return
+			}
+		}()
+	}
+}
@@ -0,0 +1,122 @@
+package kish
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+func TestPrivateTunnel(t *testing.T) {
+	rs := &KishServer{
+		Host:                "kish.example.com",
+		EnableTCPForwarding: true,
+		KeyStore: &TokenSet{Accounts: map[string]*Account{
+			"owner":    {Secrets: []string{"owner-secret"}},
+			"friend":   {Secrets: []string{"friend-secret"}},
+			"stranger": {Secrets: []string{"stranger-secret"}},
+		}},
+	}
+	if err := rs.Init(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(rs)
+	defer server.Close()
+	dial := func(path string, keyID string, params *ProxyParameters) (*websocket.Conn, int) {
+		b, _ := json.Marshal(params)
+		token, err := GenerateToken(time.Now(), []byte(keyID+"-secret"), keyID, WithAudience("kish.example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := http.Header{}
+		header.Set("Host", "kish.example.com")
+		header.Set("Authorization", "Bearer "+token)
+		header.Set("X-Kish-HTTP", base64.StdEncoding.EncodeToString(b))
+		c, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatal(err)
+			}
+			return nil, resp.StatusCode
+		}
+		return c, resp.StatusCode
+	}
+
+	c, code := dial("/proxy1", "owner", &ProxyParameters{Private: "db", AllowAccounts: []string{"friend"}})
+	if c == nil {
+		t.Fatalf("publish failed: %d", code)
+	}
+	defer c.Close()
+	publisher, err := yamux.Client(MakeRWC(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	// 公開した側はサーバーが開いたストリームに応答する
+	go func() {
+		for {
+			conn, err := publisher.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 4)
+				if _, err := io.ReadFull(conn, b); err == nil {
+					conn.Write(append([]byte("pong:"), b...))
+				}
+			}()
+		}
+	}()
+	for i := 0; rs.lookupPrivateTunnel("db") == nil; i++ {
+		if i > 100 {
+			t.Fatal("private tunnel is not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, code := dial("/proxy1", "friend", &ProxyParameters{Private: "db"}); code != http.StatusConflict {
+		t.Errorf("second publisher: %d", code)
+	}
+	// 存在しない名前と権限がない場合は区別できない
+	for _, c := range []struct {
+		keyID string
+		name  string
+	}{
+		{"stranger", "db"},
+		{"friend", "unknown"},
+	} {
+		if _, code := dial("/connect", c.keyID, &ProxyParameters{Private: c.name}); code != http.StatusNotFound {
+			t.Errorf("%s to %s: %d", c.keyID, c.name, code)
+		}
+	}
+
+	for _, keyID := range []string{"friend", "owner"} {
+		c, code := dial("/connect", keyID, &ProxyParameters{Private: "db"})
+		if c == nil {
+			t.Fatalf("%s cannot connect: %d", keyID, code)
+		}
+		session, err := yamux.Client(MakeRWC(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := session.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write([]byte("ping"))
+		b := make([]byte, 9)
+		if _, err := io.ReadFull(stream, b); err != nil || string(b) != "pong:ping" {
+			t.Errorf("%s: %q %v", keyID, b, err)
+		}
+		session.Close()
+		c.Close()
+	}
+}
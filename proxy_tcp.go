@@ -3,7 +3,7 @@ package kish
 import (
 	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 
@@ -14,52 +14,73 @@ func (rs *KishServer) runTcp(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	t := extractBearerToken(r.Header.Get("Authorization"))
-	if err := validateToken(t, rs.TokenSet); err != nil {
-		log.Printf("validateToken failed: %s", err)
+	claims, err := rs.authenticate(r)
+	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	if !rs.EnableTCPForwarding {
-		w.Header().Set("X-Error-Message", "TCP forwarding is not enabled")
-		w.WriteHeader(http.StatusBadRequest)
+	// 古いクライアントはパラメータを送ってこないことがある
+	params := &ProxyParameters{}
+	if r.Header.Get("X-Kish-HTTP") != "" {
+		params, err = parseProxyParameters(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if params.Private != "" {
+		// ポートを開かないのでEnableTCPForwardingとは関係なく使える
+		if !rs.allowDelegatedType(w, claims, FeatureTCP) {
+			return
+		}
+		rs.runPrivateTcp(w, r, claims, params)
+		return
+	}
+	if !rs.allowFeature(w, claims, FeatureTCP) {
 		return
 	}
+	defer claims.closeAtDeadline(cancel)()
+	logger := claims.logger()
 
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
-		log.Print("net.Listen:", err)
+		logger.Error("net.Listen failed", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	defer listener.Close()
 
-	respHeader := http.Header{}
+	respHeader := claims.responseHeader()
 	respHeader.Set("X-Kish-URL", "tcp://"+listener.Addr().String())
 
 	c, err := websocketUpgrader.Upgrade(w, r, respHeader)
 	if err != nil {
-		log.Print("upgrader.Upgrade:", err)
+		logger.Warn("websocket upgrade failed", "err", err)
 		return
 	}
 	defer c.Close()
 
-	session, err := yamux.Server(MakeRWC(c), nil)
+	rwc := newCountingRWC(MakeRWC(c))
+	session, err := yamux.Server(rwc, nil)
 	if err != nil {
-		log.Print("yamux.Server:", err)
+		logger.Error("yamux.Server failed", "err", err)
 		return
 	}
 	defer session.Close()
 	go func() {
 		<-session.CloseChan()
-		log.Print("yamux.Session closed")
+		logger.Debug("yamux session closed")
 		cancel()
 	}()
-	go forwardFromNetListenerToYamuxSession(listener, session)
+	logger = logger.With("tunnel", "tcp://"+listener.Addr().String())
+	logger.Info("tunnel has been established")
+	defer logger.Info("tunnel has been closed")
+	defer rs.auditTunnel(r, claims, params, AuditEvent{Type: FeatureTCP, Addr: listener.Addr().String()}, rwc)()
+	go forwardFromNetListenerToYamuxSession(listener, session, logger)
 	<-ctx.Done()
 }
 
-func forwardFromNetListenerToYamuxSession(listener net.Listener, session *yamux.Session) {
+func forwardFromNetListenerToYamuxSession(listener net.Listener, session *yamux.Session, logger *slog.Logger) {
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
@@ -67,20 +88,20 @@ func forwardFromNetListenerToYamuxSession(listener net.Listener, session *yamux.
 				// 正常終了とみなす
 				return
 			}
-			log.Printf("error Accept: %s", err)
+			logger.Error("Accept failed", "err", err)
 			return
 		}
 		go func() {
 			defer clientConn.Close()
 			serverConn, err := session.Open()
 			if err != nil {
-				log.Printf("error session.Open: %s", err)
+				logger.Warn("session.Open failed", "err", err)
 				return
 			}
 			defer serverConn.Close()
 			err = Passthrough(clientConn, serverConn)
 			if err != nil {
-				log.Printf("error Passthrough: %s", err)
+				logger.Debug("Passthrough ended with error", "err", err)
 				return
 			}
 		}()
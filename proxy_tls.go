@@ -0,0 +1,134 @@
+package kish
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/yamux"
+)
+
+type tlsPassthroughStruct struct {
+	host  string
+	ipset IPSet
+
+	session *yamux.Session
+	logger  *slog.Logger
+}
+
+func (rs *KishServer) runTls(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	claims, err := rs.authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !rs.allowFeature(w, claims, FeatureTLS) {
+		return
+	}
+
+	params, err := parseProxyParameters(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if params.Host != "" && !rs.allowFeature(w, claims, FeatureCustomHost) {
+		return
+	}
+	remoteIP := GetRemoteIP(r, rs.TrustXFF)
+	host, ok := rs.decideHost(w, params, remoteIP)
+	if !ok || !rs.allowDelegatedHost(w, claims, host) {
+		return
+	}
+	defer claims.closeAtDeadline(cancel)()
+	tp := &tlsPassthroughStruct{
+		host:   host,
+		ipset:  makeAllowIPSet(params, remoteIP),
+		logger: claims.logger().With("tunnel", "tls://"+host),
+	}
+
+	respHeader := claims.responseHeader()
+	respHeader.Set("X-Kish-URL", "tls://"+tp.host)
+	respHeader.Set("X-Kish-Allow-IP", tp.ipset.String())
+	c, err := websocketUpgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		tp.logger.Warn("websocket upgrade failed", "err", err)
+		return
+	}
+	defer c.Close()
+
+	rwc := newCountingRWC(MakeRWC(c))
+	tp.session, err = yamux.Server(rwc, nil)
+	if err != nil {
+		tp.logger.Error("yamux.Server failed", "err", err)
+		return
+	}
+	go func() {
+		<-tp.session.CloseChan()
+		cancel()
+	}()
+	defer tp.session.Close()
+
+	// SNIを送ってこないクライアントなどが平文HTTPでこのホストに来た場合のためにホスト名も押さえておく
+	err = rs.AddHostRouter(tp.host, func(sr *mux.Router) { sr.PathPrefix("/").HandlerFunc(tp.misdirectedHandler) })
+	if err != nil {
+		tp.logger.Warn("AddHostRouter failed", "err", err)
+		return
+	}
+	defer rs.DeleteHostRouter(tp.host)
+	rs.setTlsTunnel(tp.host, tp)
+	defer rs.setTlsTunnel(tp.host, nil)
+	tp.logger.Info("tunnel has been established")
+	defer tp.logger.Info("tunnel has been closed")
+	defer rs.auditTunnel(r, claims, params, AuditEvent{Type: FeatureTLS, Host: tp.host}, rwc)()
+	<-ctx.Done()
+}
+
+// ブラウザはSNIを小文字で送ってくるが、crypto/tlsは正規化しないので登録と検索の両方で小文字に揃える
+func (rs *KishServer) setTlsTunnel(host string, tp *tlsPassthroughStruct) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if tp != nil {
+		rs.tlsTunnels[strings.ToLower(host)] = tp
+	} else {
+		delete(rs.tlsTunnels, strings.ToLower(host))
+	}
+}
+
+func (rs *KishServer) lookupTlsTunnel(serverName string) *tlsPassthroughStruct {
+	if serverName == "" {
+		return nil
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.tlsTunnels[strings.ToLower(serverName)]
+}
+
+func (tp *tlsPassthroughStruct) handleConn(conn net.Conn) {
+	defer conn.Close()
+	// パススルーなのでX-Forwarded-Forは見られない
+	remoteIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || !tp.ipset.ContainsIPString(remoteIP) {
+		tp.logger.Info("connection is not allowed", "remote_ip", remoteIP)
+		return
+	}
+	serverConn, err := tp.session.Open()
+	if err != nil {
+		tp.logger.Warn("session.Open failed", "err", err)
+		return
+	}
+	defer serverConn.Close()
+	err = Passthrough(conn, serverConn)
+	if err != nil {
+		tp.logger.Debug("Passthrough ended with error", "err", err)
+	}
+}
+
+func (tp *tlsPassthroughStruct) misdirectedHandler(w http.ResponseWriter, req *http.Request) {
+	http.Error(w, "This host only accepts TLS connections with SNI", http.StatusMisdirectedRequest)
+}
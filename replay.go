@@ -0,0 +1,148 @@
+package kish
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultReplayCacheSize = 100000
+
+var (
+	ErrTokenReplayed   = errors.New("token has already been used")
+	ErrReplayCacheFull = errors.New("replay cache is full")
+	ErrInvalidTokenID  = errors.New("invalid token ID")
+)
+
+// 使用済みトークンのIDを有効期限まで覚えておく。
+// Pathを指定すると追記していき、再起動しても覚えている
+type ReplayCache struct {
+	Path       string
+	MaxEntries int
+
+	mu       sync.Mutex
+	entries  map[string]time.Time
+	file     *os.File
+	appended int
+}
+
+func (rc *ReplayCache) maxEntries() int {
+	if rc.MaxEntries > 0 {
+		return rc.MaxEntries
+	}
+	return defaultReplayCacheSize
+}
+
+// Pathのファイルから読み込み、期限切れを除いて書き直す
+func (rc *ReplayCache) Load(now time.Time) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries = map[string]time.Time{}
+	if rc.Path == "" {
+		return nil
+	}
+	f, err := os.Open(rc.Path)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			id, exp, ok := strings.Cut(scanner.Text(), " ")
+			if !ok {
+				continue
+			}
+			sec, err := strconv.ParseInt(exp, 10, 64)
+			if err != nil {
+				continue
+			}
+			if t := time.Unix(sec, 0); t.After(now) {
+				rc.entries[id] = t
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return rc.rewrite()
+}
+
+func (rc *ReplayCache) rewrite() error {
+	if rc.file != nil {
+		rc.file.Close()
+		rc.file = nil
+	}
+	tmp := rc.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for id, exp := range rc.entries {
+		fmt.Fprintf(w, "%s %d\n", id, exp.Unix())
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, rc.Path); err != nil {
+		return err
+	}
+	rc.file, err = os.OpenFile(rc.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	rc.appended = 0
+	return err
+}
+
+func (rc *ReplayCache) sweep(now time.Time) {
+	for id, exp := range rc.entries {
+		if !exp.After(now) {
+			delete(rc.entries, id)
+		}
+	}
+}
+
+// 初めて見たIDなら記録してnilを返す
+func (rc *ReplayCache) Check(id string, exp time.Time, now time.Time) error {
+	// ファイルに1行1件で書くので空白や改行が入っていると困る
+	if strings.ContainsAny(id, " \t\r\n") {
+		return ErrInvalidTokenID
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.entries == nil {
+		rc.entries = map[string]time.Time{}
+	}
+	if e, ok := rc.entries[id]; ok && e.After(now) {
+		return ErrTokenReplayed
+	}
+	if len(rc.entries) >= rc.maxEntries() {
+		rc.sweep(now)
+		// 古いものを捨てると再利用できてしまうので、溢れたら受け付けない
+		if len(rc.entries) >= rc.maxEntries() {
+			return ErrReplayCacheFull
+		}
+	}
+	rc.entries[id] = exp
+	if rc.file != nil {
+		if _, err := fmt.Fprintf(rc.file, "%s %d\n", id, exp.Unix()); err != nil {
+			slog.Error("ReplayCache: failed to append", "path", rc.Path, "err", err)
+		}
+		rc.appended++
+		if rc.appended > rc.maxEntries() {
+			rc.sweep(now)
+			if err := rc.rewrite(); err != nil {
+				slog.Error("ReplayCache: failed to rewrite", "path", rc.Path, "err", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package kish
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayCacheCheck(t *testing.T) {
+	now := time.Unix(10000, 0)
+	rc := ReplayCache{MaxEntries: 2}
+	if err := rc.Check("a", now.Add(time.Minute), now); err != nil {
+		t.Errorf("first use should be accepted: %+v", err)
+	}
+	if err := rc.Check("a", now.Add(time.Minute), now); !errors.Is(err, ErrTokenReplayed) {
+		t.Errorf("err is unexpected: %+v", err)
+	}
+	if err := rc.Check("b", now.Add(time.Minute), now); err != nil {
+		t.Errorf("err should be nil: %+v", err)
+	}
+	if err := rc.Check("c", now.Add(time.Minute), now); !errors.Is(err, ErrReplayCacheFull) {
+		t.Errorf("err is unexpected: %+v", err)
+	}
+	// 期限が切れたものは捨てられて空きができる
+	later := now.Add(2 * time.Minute)
+	if err := rc.Check("c", later.Add(time.Minute), later); err != nil {
+		t.Errorf("err should be nil: %+v", err)
+	}
+	if err := rc.Check("bad id", later.Add(time.Minute), later); !errors.Is(err, ErrInvalidTokenID) {
+		t.Errorf("err is unexpected: %+v", err)
+	}
+}
+
+func TestReplayCachePersist(t *testing.T) {
+	now := time.Unix(10000, 0)
+	path := filepath.Join(t.TempDir(), "replay")
+	rc1 := ReplayCache{Path: path}
+	if err := rc1.Load(now); err != nil {
+		t.Fatalf("Load: %+v", err)
+	}
+	rc1.Check("a", now.Add(time.Minute), now)
+	rc1.Check("b", now.Add(time.Hour), now)
+
+	rc2 := ReplayCache{Path: path}
+	later := now.Add(2 * time.Minute)
+	if err := rc2.Load(later); err != nil {
+		t.Fatalf("Load: %+v", err)
+	}
+	if err := rc2.Check("a", later.Add(time.Minute), later); err != nil {
+		t.Errorf("expired id should be forgotten: %+v", err)
+	}
+	if err := rc2.Check("b", later.Add(time.Minute), later); !errors.Is(err, ErrTokenReplayed) {
+		t.Errorf("err is unexpected: %+v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package kish
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrSealedValueInvalid = errors.New("sealed value is invalid")
+	ErrSealedValueExpired = errors.New("sealed value has expired")
+)
+
+// cookieやURLに載せる値をAES-GCMで暗号化する。purposeを付加データにして用途の取り違えを防ぐ
+type sealer struct {
+	aead cipher.AEAD
+}
+
+type sealedEnvelope struct {
+	Exp  int64           `json:"exp"`
+	Data json.RawMessage `json:"data"`
+}
+
+// keyがnilなら乱数で作る。その場合再起動すると以前の値は開けなくなる
+func newSealer(key []byte) (*sealer, error) {
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+func (s *sealer) seal(purpose string, v interface{}, exp time.Time) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	plain, err := json.Marshal(&sealedEnvelope{Exp: exp.Unix(), Data: data})
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plain, []byte(purpose))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (s *sealer) open(purpose string, token string, v interface{}, now time.Time) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return ErrSealedValueInvalid
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, []byte(purpose))
+	if err != nil {
+		return ErrSealedValueInvalid
+	}
+	var env sealedEnvelope
+	if err := json.Unmarshal(plain, &env); err != nil {
+		return ErrSealedValueInvalid
+	}
+	if now.Unix() >= env.Exp {
+		return ErrSealedValueExpired
+	}
+	return json.Unmarshal(env.Data, v)
+}
@@ -4,36 +4,193 @@ package kish
 // https://github.com/gorilla/mux/issues/82
 
 import (
+	"crypto/tls"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 )
 
 type BuildFunc func(*mux.Router)
 
 type KishServer struct {
-	Host                string
-	ProxyDomainSuffix   string
-	mu                  sync.Mutex
-	root                *mux.Router
-	buildFuncs          map[string]BuildFunc
-	TokenSet            *TokenSet
+	Host              string
+	ProxyDomainSuffix string
+	mu                sync.Mutex
+	root              *mux.Router
+	buildFuncs        map[string]BuildFunc
+	tlsTunnels        map[string]*tlsPassthroughStruct
+	privateTunnels    map[string]*privateTunnel
+	// TokenSet, EnvKeyStore, DirKeyStore, HTTPKeyStoreなど
+	KeyStore            KeyStore
 	TrustXFF            bool
 	EnableTCPForwarding bool
+	EnableUDPForwarding bool
+	// nilの場合はInitでメモリ上のものが作られる
+	ReplayCache *ReplayCache
+	// trueの場合、X-Kish-HTTPのハッシュを含まないトークンを拒否する
+	RequireSignedParameters bool
+	// 設定するとトンネルでOIDCによるログインを要求できる
+	OIDC *OIDCConfig
+	oidc *oidcProvider
+	// trueの場合、クライアント証明書を指定したトンネルへのTLS接続で証明書を要求する
+	RequestClientCert bool
+	clientCertHosts   map[string]bool
+	// nilなら監査ログを書かない
+	AuditLog *AuditLog
+	// nilならトンネルごとのアクセスログをファイルに書かない
+	AccessLog *AccessLogConfig
+	// 訪問者のJWTの検証でクライアントが指定できるJWKSのURL。空ならURLは使えず、JWKSを直接送る必要がある
+	AllowJWKSURLs []string
 }
 
-func (rs *KishServer) Init() {
+func (rs *KishServer) Init() error {
 	rs.root = mux.NewRouter()
 	rs.buildFuncs = map[string]BuildFunc{}
-	rs.AddHostRouter(rs.Host, rs.configRouter)
+	rs.tlsTunnels = map[string]*tlsPassthroughStruct{}
+	rs.privateTunnels = map[string]*privateTunnel{}
+	rs.clientCertHosts = map[string]bool{}
+	if rs.ReplayCache == nil {
+		rs.ReplayCache = &ReplayCache{}
+	}
+	if rs.AccessLog != nil {
+		if err := CheckAccessLogFormat(rs.AccessLog.Format); err != nil {
+			return err
+		}
+	}
+	if rs.OIDC != nil {
+		var err error
+		rs.oidc, err = newOIDCProvider(*rs.OIDC, rs.Host)
+		if err != nil {
+			return err
+		}
+	}
+	return rs.AddHostRouter(rs.Host, rs.configRouter)
+}
+
+// トークンの検証に加えて、このサーバー宛てであること、アカウントに許された接続元であること、
+// 再利用されていないことを確認する
+func (rs *KishServer) authenticate(r *http.Request) (*proxyClaims, error) {
+	t := extractBearerToken(r.Header.Get("Authorization"))
+	claims, err := rs.verifyRequestToken(r, t)
+	if err != nil {
+		slog.Warn("authentication failed", "endpoint", r.URL.Path, "remote_ip", GetRemoteIP(r, rs.TrustXFF), "err", err)
+	}
+	rs.auditAuth(r, t, claims, err)
+	return claims, err
+}
+
+func (rs *KishServer) verifyRequestToken(r *http.Request, t string) (*proxyClaims, error) {
+	claims, err := validateToken(t, rs.KeyStore, jwt.WithAudience(audienceOf(rs.Host)))
+	if err != nil {
+		return nil, err
+	}
+	if remoteIP := GetRemoteIP(r, rs.TrustXFF); !claims.account.allowsRemoteIP(remoteIP) {
+		return nil, fmt.Errorf("%w: %s from %s", ErrRemoteIPNotAllowed, claims.KeyID, remoteIP)
+	}
+	if err := claims.verifyParameters(r.Header.Get("X-Kish-HTTP"), rs.RequireSignedParameters); err != nil {
+		return nil, err
+	}
+	if err := rs.ReplayCache.Check(claims.ID, claims.ExpiresAt.Time, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// 鍵の期限が近いことをクライアントが警告できるように、期限があれば知らせる
+func (c *proxyClaims) responseHeader() http.Header {
+	h := http.Header{}
+	if c.account == nil {
+		return h
+	}
+	expires := c.account.keyExpires(c.KeyVersion)
+	if c.delegation != nil {
+		expires = c.account.keyExpires(c.delegation.KeyVersion)
+		if d := c.delegation.ExpiresAt.Time; expires.IsZero() || d.Before(expires) {
+			expires = d
+		}
+	}
+	if !expires.IsZero() {
+		h.Set("X-Kish-Key-Expires", expires.UTC().Format(time.RFC3339))
+	}
+	return h
+}
+
+// アカウントに許可されていなければレスポンスを書いてfalseを返す。
+// Featuresを書いていないアカウントはサーバーの設定に従う
+func (rs *KishServer) allowFeature(w http.ResponseWriter, claims *proxyClaims, feature string) bool {
+	var defaultValue bool
+	var msg string
+	switch feature {
+	case FeatureTCP:
+		defaultValue, msg = rs.EnableTCPForwarding, "TCP forwarding is not enabled"
+	case FeatureUDP:
+		defaultValue, msg = rs.EnableUDPForwarding, "UDP forwarding is not enabled"
+	case FeatureCustomHost:
+		defaultValue, msg = true, "custom hostname is not allowed"
+	default:
+		defaultValue, msg = true, fmt.Sprintf("%s tunnel is not allowed", strings.ToUpper(feature))
+	}
+	if claims.account.Allows(feature, defaultValue) {
+		return feature == FeatureCustomHost || rs.allowDelegatedType(w, claims, feature)
+	}
+	slog.Info("tunnel is refused", "account", claims.KeyID, "reason", msg)
+	w.Header().Set("X-Error-Message", msg)
+	w.WriteHeader(http.StatusBadRequest)
+	return false
+}
+
+func audienceOf(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
 }
 
 func (rs *KishServer) configRouter(sr *mux.Router) {
+	rs.tunnelRouter(sr)
+	sr.HandleFunc("/session", rs.runSession)
+	if rs.oidc != nil {
+		sr.HandleFunc(rs.oidc.startURL().Path, rs.oidc.startHandler)
+		sr.HandleFunc(rs.oidc.redirectURL.Path, rs.oidc.callbackHandler)
+	}
+}
+
+// /sessionの中からも使うエンドポイント
+func (rs *KishServer) tunnelRouter(sr *mux.Router) {
 	sr.HandleFunc("/proxy1", rs.runTcp)
 	sr.HandleFunc("/proxy2", rs.runHttp)
+	sr.HandleFunc("/proxy3", rs.runTls)
+	sr.HandleFunc("/proxy4", rs.runUdp)
+	sr.HandleFunc("/connect", rs.runConnect)
+}
+
+// 管理用。Prometheusのテキスト形式で返すので、外から見えないアドレスで待ち受けること
+func (rs *KishServer) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if ts, ok := rs.KeyStore.(*TokenSet); ok && ts.Path != "" {
+		status := ts.Status()
+		fmt.Fprintf(w, "kish_accounts_loaded %d\n", status.Accounts)
+		if !status.ModTime.IsZero() {
+			fmt.Fprintf(w, "kish_accounts_mod_time_seconds %d\n", status.ModTime.Unix())
+		}
+		fmt.Fprintf(w, "kish_accounts_load_errors_total %d\n", status.LoadErrors)
+	}
+}
+
+// 別のgoroutineから呼ぶ場合
+func (rs *KishServer) hostRegistered(host string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	_, ok := rs.buildFuncs[host]
+	return ok
 }
 
 func (rs *KishServer) isOccupied(host string) bool {
@@ -42,7 +199,7 @@ func (rs *KishServer) isOccupied(host string) bool {
 }
 
 func (rs *KishServer) AddHostRouter(host string, buildFunc BuildFunc) error {
-	log.Printf("register host %s", host)
+	slog.Debug("register host", "host", host)
 	err := func() error {
 		rs.mu.Lock()
 		defer rs.mu.Unlock()
@@ -53,7 +210,7 @@ func (rs *KishServer) AddHostRouter(host string, buildFunc BuildFunc) error {
 		return nil
 	}()
 	if err != nil {
-		return nil
+		return err
 	}
 	sr := rs.root.Host(host).Subrouter()
 	buildFunc(sr)
@@ -61,14 +218,22 @@ func (rs *KishServer) AddHostRouter(host string, buildFunc BuildFunc) error {
 }
 
 func (rs *KishServer) DeleteHostRouter(host string) {
-	log.Printf("unregister host %s", host)
+	slog.Debug("unregister host", "host", host)
+	rs.mu.Lock()
 	delete(rs.buildFuncs, host)
+	rs.mu.Unlock()
 	rs.rebuild()
 }
 
 func (rs *KishServer) rebuild() {
 	r := mux.NewRouter()
+	rs.mu.Lock()
+	buildFuncs := make(map[string]BuildFunc, len(rs.buildFuncs))
 	for host, bf := range rs.buildFuncs {
+		buildFuncs[host] = bf
+	}
+	rs.mu.Unlock()
+	for host, bf := range buildFuncs {
 		sr := r.Host(host).Subrouter()
 		bf(sr)
 	}
@@ -83,3 +248,35 @@ func (rs *KishServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	rs.mu.Unlock()
 	root.ServeHTTP(w, r)
 }
+
+// SNIがTLSパススルーのトンネルに一致する接続はそちらに流し、それ以外をHTTP(S)として処理する
+func (rs *KishServer) ListenAndServe(addr string, certFile string, keyFile string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	pl := newPassthroughListener(l, rs.lookupTlsTunnel)
+	defer pl.Close()
+	srv := &http.Server{Handler: rs}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if rs.RequestClientCert {
+			srv.TLSConfig.GetConfigForClient = rs.tlsConfigForClient(srv.TLSConfig.Clone())
+		}
+		return srv.ServeTLS(pl, "", "")
+	}
+	return srv.Serve(pl)
+}
+
+// トンネルごとのログにつける属性
+func (c *proxyClaims) logger() *slog.Logger {
+	logger := slog.With("account", c.KeyID)
+	if c.delegation != nil {
+		logger = logger.With("delegation", c.delegation.ID)
+	}
+	return logger
+}
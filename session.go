@@ -0,0 +1,51 @@
+package kish
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/yamux"
+)
+
+// 1本のwebsocketの上で複数のトンネルを張るためのエンドポイント。
+// yamuxの各ストリームをHTTPの接続とみなして/proxy1などをそのまま提供する
+func (rs *KishServer) runSession(w http.ResponseWriter, r *http.Request) {
+	claims, err := rs.authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	logger := claims.logger().With("remote_ip", GetRemoteIP(r, rs.TrustXFF))
+	c, err := websocketUpgrader.Upgrade(w, r, claims.responseHeader())
+	if err != nil {
+		logger.Warn("websocket upgrade failed", "err", err)
+		return
+	}
+	defer c.Close()
+
+	session, err := yamux.Server(MakeRWC(c), nil)
+	if err != nil {
+		logger.Error("yamux.Server failed", "err", err)
+		return
+	}
+	defer session.Close()
+
+	tunnels := mux.NewRouter()
+	rs.tunnelRouter(tunnels)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// ストリームのアドレスは意味がないので外側の接続元を引き継ぐ
+			req.RemoteAddr = r.RemoteAddr
+			req.Header.Del("X-Forwarded-For")
+			for _, v := range r.Header.Values("X-Forwarded-For") {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			tunnels.ServeHTTP(w, req)
+		}),
+	}
+	logger.Info("session has been established")
+	// sessionが閉じられるとAcceptがエラーになって戻ってくる
+	err = srv.Serve(session)
+	logger.Info("session has been closed", "err", err)
+}
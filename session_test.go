@@ -0,0 +1,123 @@
+package kish
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+func sessionTestHeader(t *testing.T, audience string, params *ProxyParameters) http.Header {
+	b, _ := json.Marshal(params)
+	param := base64.StdEncoding.EncodeToString(b)
+	token, err := GenerateToken(time.Now(), []byte("s"), "user1", WithAudience(audience), WithParameters(param))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{}
+	h.Set("Authorization", "Bearer "+token)
+	h.Set("X-Kish-HTTP", param)
+	return h
+}
+
+func TestSession(t *testing.T) {
+	rs := &KishServer{
+		Host:              "kish.example.com",
+		ProxyDomainSuffix: ".kish.example.com",
+		TrustXFF:          true,
+		KeyStore: &TokenSet{Accounts: map[string]*Account{
+			"user1": {Secrets: []string{"s"}, AllowIP: []string{"192.0.2.0/24"}},
+		}},
+	}
+	if err := rs.Init(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(rs)
+	defer server.Close()
+	outerURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/session"
+
+	// 外側の接続元はアカウントのallow-ipに含まれていなければならない
+	header := sessionTestHeader(t, "kish.example.com", &ProxyParameters{})
+	header.Set("Host", "kish.example.com")
+	header.Set("X-Forwarded-For", "198.51.100.1")
+	if _, resp, err := websocket.DefaultDialer.Dial(outerURL, header); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("session from outside of allow-ip is accepted: %v", err)
+	}
+
+	header = sessionTestHeader(t, "kish.example.com", &ProxyParameters{})
+	header.Set("Host", "kish.example.com")
+	header.Set("X-Forwarded-For", "192.0.2.7")
+	outer, _, err := websocket.DefaultDialer.Dial(outerURL, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outer.Close()
+	session, err := yamux.Client(MakeRWC(outer), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return session.Open()
+		},
+	}
+	dialInner := func(header http.Header) (*websocket.Conn, *http.Response, error) {
+		// 内側のリクエストが付けたX-Forwarded-Forは使われない
+		header.Set("X-Forwarded-For", "203.0.113.1")
+		return dialer.Dial("ws://kish.example.com/proxy2", header)
+	}
+
+	// 内側のトンネルを2本張る
+	for _, host := range []string{"a.kish.example.com", "b.kish.example.com"} {
+		header := sessionTestHeader(t, "kish.example.com", &ProxyParameters{Host: host, AllowMyIP: true})
+		inner, resp, err := dialInner(header)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		defer inner.Close()
+		// allow-my-ipは外側の接続元になる
+		if got := resp.Header.Get("X-Kish-Allow-IP"); got != "192.0.2.7/32" {
+			t.Errorf("%s: X-Kish-Allow-IP = %s", host, got)
+		}
+		tunnel, err := yamux.Client(MakeRWC(inner), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+		go serveTarget(tunnel)
+	}
+	for _, host := range []string{"a.kish.example.com", "b.kish.example.com"} {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		req.Header.Set("X-Forwarded-For", "192.0.2.7")
+		rec := httptest.NewRecorder()
+		rs.ServeHTTP(rec, req)
+		if b, _ := io.ReadAll(rec.Body); rec.Code != http.StatusOK || string(b) != "hello" {
+			t.Errorf("%s: %d %s", host, rec.Code, b)
+		}
+	}
+
+	// 内側のリクエストもそれぞれ認証される
+	header = sessionTestHeader(t, "kish.example.com", &ProxyParameters{Host: "c.kish.example.com"})
+	inner, _, err := dialInner(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner.Close()
+	if _, resp, err := dialInner(header); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replayed token is accepted: %v", err)
+	}
+	header = sessionTestHeader(t, "other.example.com", &ProxyParameters{Host: "d.kish.example.com"})
+	if _, resp, err := dialInner(header); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token for another server is accepted: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package kish
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	shareCookie      = "kish_share"
+	sharePath        = kishReservedPathPrefix + "share"
+	shareKeySize     = 32
+	maxShareLifetime = 30 * 24 * time.Hour
+)
+
+var (
+	ErrShareLinkInvalid = errors.New("share link is invalid")
+	ErrShareLinkExpired = errors.New("share link has expired")
+)
+
+func newShareKey() ([]byte, error) {
+	key := make([]byte, shareKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func shareSignature(key []byte, host string, path string, exp int64) []byte {
+	m := hmac.New(sha256.New, key)
+	fmt.Fprintf(m, "%s\n%s\n%d", host, path, exp)
+	return m.Sum(nil)
+}
+
+// トンネル登録時にX-Kish-Share-Keyで受け取った鍵で共有リンクを作る。
+// tunnelURLはX-Kish-URLの値、pathは開いたときに表示するパス
+func MakeShareURL(tunnelURL string, key []byte, path string, exp time.Time) (string, error) {
+	u, err := url.Parse(tunnelURL)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		path = "/"
+	}
+	path = safeReturnTo(path)
+	q := url.Values{
+		"path": {path},
+		"exp":  {strconv.FormatInt(exp.Unix(), 10)},
+		"sig":  {base64.RawURLEncoding.EncodeToString(shareSignature(key, u.Hostname(), path, exp.Unix()))},
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: sharePath, RawQuery: q.Encode()}).String(), nil
+}
+
+func verifyShareLink(key []byte, host string, q url.Values, now time.Time) (string, time.Time, error) {
+	path := q.Get("path")
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return "", time.Time{}, ErrShareLinkInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(q.Get("sig"))
+	if err != nil || !hmac.Equal(sig, shareSignature(key, host, path, exp)) {
+		return "", time.Time{}, ErrShareLinkInvalid
+	}
+	expTime := time.Unix(exp, 0)
+	if !now.Before(expTime) {
+		return "", time.Time{}, ErrShareLinkExpired
+	}
+	// 鍵が漏れていない限り起きないが、cookieが長く残りすぎないようにする
+	if expTime.Sub(now) > maxShareLifetime {
+		expTime = now.Add(maxShareLifetime)
+	}
+	return safeReturnTo(path), expTime, nil
+}
+
+// 共有リンクをこのトンネル用のcookieに交換する
+func (p *proxy2Struct) shareHandler(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	path, exp, err := verifyShareLink(p.shareKey, p.host, req.URL.Query(), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	value, err := p.shareCookie.sign("", exp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(exp.Sub(now).Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, path, http.StatusFound)
+}
+
+func (p *proxy2Struct) hasShareCookie(req *http.Request) bool {
+	if p.shareCookie == nil {
+		return false
+	}
+	c, err := req.Cookie(shareCookie)
+	if err != nil {
+		return false
+	}
+	_, err = p.shareCookie.verify(c.Value, time.Now())
+	return err == nil
+}
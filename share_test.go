@@ -0,0 +1,69 @@
+package kish
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newShareTunnel(t *testing.T) (*proxy2Struct, http.Handler) {
+	p := &proxy2Struct{
+		host:      "app.kish.test",
+		basicAuth: map[string]string{"alice": "secret"},
+		limiter:   newAuthLimiter(),
+		events:    newEventSink(),
+	}
+	var err error
+	if p.shareKey, err = newShareKey(); err != nil {
+		t.Fatal(err)
+	}
+	if p.shareCookie, err = newCookieSigner(p.host); err != nil {
+		t.Fatal(err)
+	}
+	return p, tunnelHandler(p)
+}
+
+func TestShareLink(t *testing.T) {
+	p, tunnel := newShareTunnel(t)
+	if rec := serve(tunnel, "GET", "http://app.kish.test/docs", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status is unexpected: %d", rec.Code)
+	}
+	link, err := MakeShareURL("https://app.kish.test", p.shareKey, "/docs?page=2", time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := serve(tunnel, "GET", link, nil)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/docs?page=2" {
+		t.Fatalf("share link is not accepted: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = serve(tunnel, "GET", "http://app.kish.test/docs", rec.Result().Cookies())
+	if rec.Code != http.StatusOK {
+		t.Errorf("share cookie is not accepted: %d", rec.Code)
+	}
+}
+
+func TestShareLinkRejected(t *testing.T) {
+	p, tunnel := newShareTunnel(t)
+	now := time.Now()
+	valid, _ := MakeShareURL("https://app.kish.test", p.shareKey, "/", now.Add(time.Hour))
+	expired, _ := MakeShareURL("https://app.kish.test", p.shareKey, "/", now.Add(-time.Second))
+	otherHost, _ := MakeShareURL("https://other.kish.test", p.shareKey, "/", now.Add(time.Hour))
+	// トンネルを作り直すと鍵が変わる
+	closedKey, _ := newShareKey()
+	closed, _ := MakeShareURL("https://app.kish.test", closedKey, "/", now.Add(time.Hour))
+	u := mustParseURL(valid)
+	q := u.Query()
+	q.Set("path", "/admin")
+	u.RawQuery = q.Encode()
+	for name, link := range map[string]string{
+		"expired":    expired,
+		"other host": "https://app.kish.test" + mustParseURL(otherHost).RequestURI(),
+		"closed":     closed,
+		"tampered":   u.String(),
+	} {
+		rec := serve(tunnel, "GET", link, nil)
+		if rec.Code != http.StatusForbidden || len(rec.Result().Cookies()) != 0 {
+			t.Errorf("%s: status is unexpected: %d", name, rec.Code)
+		}
+	}
+}
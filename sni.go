@@ -0,0 +1,156 @@
+package kish
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const clientHelloTimeout = 10 * time.Second
+
+// 先頭の読み込み済みバイト列を返してから元のConnを読むConn
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// tls.Serverに読ませるだけで書き込みはさせないためのConn
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var errClientHelloRead = errors.New("client hello has been read")
+
+// ClientHelloを読んでSNIを取り出す。読んだバイト列も返すので呼び出し側で再生すること
+func readClientHello(r io.Reader) (string, []byte, error) {
+	peeked := new(bytes.Buffer)
+	var serverName string
+	var gotHello bool
+	err := tls.Server(readOnlyConn{io.TeeReader(r, peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			gotHello = true
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !gotHello {
+		return "", peeked.Bytes(), err
+	}
+	return serverName, peeked.Bytes(), nil
+}
+
+// 登録されたホスト名宛てのTLS接続をHTTPサーバーに渡さずにそのまま横流しするListener
+type passthroughListener struct {
+	net.Listener
+	lookup func(serverName string) *tlsPassthroughStruct
+	conns  chan net.Conn
+	errCh  chan error
+	once   sync.Once
+	done   chan struct{}
+}
+
+func newPassthroughListener(l net.Listener, lookup func(string) *tlsPassthroughStruct) *passthroughListener {
+	pl := &passthroughListener{
+		Listener: l,
+		lookup:   lookup,
+		conns:    make(chan net.Conn),
+		errCh:    make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+// 閉じられるまで終わらない。EMFILEなどの一時的なエラーはhttp.Serverと同じように待ってから再試行する
+func (pl *passthroughListener) acceptLoop() {
+	var delay time.Duration
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			select {
+			case <-pl.done:
+				pl.errCh <- err
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				pl.errCh <- err
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			slog.Warn("accept error", "err", err, "retry", delay)
+			select {
+			case <-time.After(delay):
+			case <-pl.done:
+			}
+			continue
+		}
+		delay = 0
+		go pl.dispatch(conn)
+	}
+}
+
+func (pl *passthroughListener) dispatch(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	bufR := bufio.NewReader(conn)
+	first, err := bufR.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var c net.Conn = &prefixConn{conn, bufR}
+	// 0x16はTLSのhandshakeレコード。それ以外は平文のHTTPとみなす
+	if first[0] == 0x16 {
+		serverName, peeked, _ := readClientHello(bufR)
+		c = &prefixConn{conn, io.MultiReader(bytes.NewReader(peeked), bufR)}
+		if tp := pl.lookup(serverName); tp != nil {
+			conn.SetReadDeadline(time.Time{})
+			tp.handleConn(c)
+			return
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	select {
+	case pl.conns <- c:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+func (pl *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-pl.conns:
+		return c, nil
+	case err := <-pl.errCh:
+		pl.errCh <- err
+		return nil, err
+	}
+}
+
+func (pl *passthroughListener) Close() error {
+	pl.once.Do(func() { close(pl.done) })
+	return pl.Listener.Close()
+}
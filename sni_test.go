@@ -0,0 +1,115 @@
+package kish
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestReadClientHello(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+	go func() {
+		c := tls.Client(clientSide, &tls.Config{ServerName: "abc.kish.example.com"})
+		c.Handshake()
+		clientSide.Close()
+	}()
+	serverName, peeked, err := readClientHello(serverSide)
+	if err != nil {
+		t.Fatalf("err: %+v", err)
+	}
+	if serverName != "abc.kish.example.com" {
+		t.Errorf("serverName is unexpected: %s", serverName)
+	}
+	if len(peeked) == 0 || peeked[0] != 0x16 {
+		t.Errorf("peeked is unexpected: %v", peeked)
+	}
+}
+
+func TestPassthroughListenerPlain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := newPassthroughListener(l, func(string) *tlsPassthroughStruct { return nil })
+	defer pl.Close()
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		c.Close()
+	}()
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b, _ := io.ReadAll(conn)
+	if !bytes.Equal(b, []byte("GET / HTTP/1.1\r\n\r\n")) {
+		t.Errorf("data is unexpected: %q", b)
+	}
+}
+
+// 最初のAcceptだけ一時的なエラーを返すListener
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestPassthroughListenerTemporaryError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := newPassthroughListener(&flakyListener{Listener: l}, func(string) *tlsPassthroughStruct { return nil })
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		c.Close()
+	}()
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("temporary error is not retried: %v", err)
+	}
+	conn.Close()
+	pl.Close()
+	if _, err := pl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("err after Close: %v", err)
+	}
+}
+
+func TestLookupTlsTunnelCase(t *testing.T) {
+	rs := &KishServer{Host: "kish.example.com"}
+	if err := rs.Init(); err != nil {
+		t.Fatal(err)
+	}
+	tp := &tlsPassthroughStruct{host: "MyApp.kish.example.com"}
+	rs.setTlsTunnel(tp.host, tp)
+	// ブラウザは小文字で送ってくる
+	for _, name := range []string{"myapp.kish.example.com", "MyApp.kish.example.com", "MYAPP.KISH.EXAMPLE.COM"} {
+		if rs.lookupTlsTunnel(name) != tp {
+			t.Errorf("%s is not found", name)
+		}
+	}
+	rs.setTlsTunnel(tp.host, nil)
+	if rs.lookupTlsTunnel("myapp.kish.example.com") != nil {
+		t.Errorf("tunnel is not removed")
+	}
+}
@@ -0,0 +1,114 @@
+package kish
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 訪問者がヘッダーかクエリパラメータで渡す秘密の値。HeaderとQueryのどちらか一方を指定する
+type TokenAuth struct {
+	Header string `json:"header,omitempty"`
+	Query  string `json:"query,omitempty"`
+	// 平文かbcrypt, argon2, SHA-cryptのハッシュ
+	Value string `json:"value"`
+}
+
+var (
+	ErrInvalidTokenAuth = errors.New("token auth must have a value and either header or query")
+	ErrEmptyAPIKey      = errors.New("api key is empty")
+)
+
+// 転送に使うので差し替えられると困るヘッダー
+var reservedTokenHeaders = []string{"Host", "Connection", "Upgrade", "Content-Length", "Transfer-Encoding", "Cookie"}
+
+func (ta *TokenAuth) validate() error {
+	if ta.Value == "" || (ta.Header == "") == (ta.Query == "") {
+		return ErrInvalidTokenAuth
+	}
+	for _, h := range reservedTokenHeaders {
+		if strings.EqualFold(ta.Header, h) {
+			return ErrInvalidTokenAuth
+		}
+	}
+	return checkPasswordHash(ta.Value)
+}
+
+func validateAPIKey(key string) error {
+	if key == "" {
+		return ErrEmptyAPIKey
+	}
+	return checkPasswordHash(key)
+}
+
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// 一致すればtrue。何らかの値が送られてきていればpresentedがtrueになる
+func (p *proxy2Struct) checkToken(req *http.Request) (ok bool, presented bool) {
+	if len(p.apiKeys) > 0 {
+		if token, exist := bearerToken(req); exist && token != "" {
+			presented = true
+			for _, key := range p.apiKeys {
+				if p.verifyPasswordCached("\x00apikey", key, token) {
+					return true, true
+				}
+			}
+		}
+	}
+	query := req.URL.Query()
+	for _, ta := range p.tokenAuth {
+		var value string
+		if ta.Header != "" {
+			value = req.Header.Get(ta.Header)
+		} else {
+			value = query.Get(ta.Query)
+		}
+		if value == "" {
+			continue
+		}
+		presented = true
+		if p.verifyPasswordCached("\x00token", ta.Value, value) {
+			return true, true
+		}
+	}
+	return false, presented
+}
+
+// 訪問者の秘密の値をターゲットに渡さないように消す
+func (p *proxy2Struct) stripTokens(req *http.Request) {
+	if len(p.apiKeys) > 0 {
+		if _, ok := bearerToken(req); ok {
+			req.Header.Del("Authorization")
+		}
+	}
+	for _, ta := range p.tokenAuth {
+		if ta.Header != "" {
+			req.Header.Del(ta.Header)
+		} else {
+			req.URL.RawQuery = removeQueryParam(req.URL.RawQuery, ta.Query)
+		}
+	}
+}
+
+// url.Values.Encodeは並び順を変えてしまうので、該当するものだけ取り除く
+func removeQueryParam(rawQuery string, name string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var kept []string
+	for _, kv := range strings.Split(rawQuery, "&") {
+		k, _, _ := strings.Cut(kv, "=")
+		if key, err := url.QueryUnescape(k); err == nil && key == name {
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	return strings.Join(kept, "&")
+}
@@ -0,0 +1,90 @@
+package kish
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenAuth(t *testing.T) {
+	p := &proxy2Struct{
+		host:    "app.kish.test",
+		apiKeys: []string{"key1"},
+		tokenAuth: []TokenAuth{
+			{Header: "X-Hub-Token", Value: "hub"},
+			{Query: "token", Value: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		},
+		limiter: newAuthLimiter(),
+		events:  newEventSink(),
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if p.authorize(w, req, "192.0.2.1") {
+			w.Write([]byte(req.Header.Get("Authorization") + "|" + req.Header.Get("X-Hub-Token") + "|" + req.URL.RawQuery))
+		}
+	})
+	for _, c := range []struct {
+		url    string
+		header [2]string
+		code   int
+		body   string
+	}{
+		{"/", [2]string{}, http.StatusUnauthorized, ""},
+		{"/", [2]string{"Authorization", "Bearer key1"}, http.StatusOK, "||"},
+		{"/", [2]string{"Authorization", "bearer  key1 "}, http.StatusOK, "||"},
+		{"/", [2]string{"Authorization", "Bearer key2"}, http.StatusUnauthorized, ""},
+		{"/", [2]string{"Authorization", "Bearer "}, http.StatusUnauthorized, ""},
+		{"/", [2]string{"X-Hub-Token", "hub"}, http.StatusOK, "||"},
+		{"/?b=1&token=Hello%20world!&a=2", [2]string{}, http.StatusOK, "||b=1&a=2"},
+		{"/?token=wrong", [2]string{}, http.StatusUnauthorized, ""},
+		// 認証に使わなかった値も転送しない
+		{"/?token=Hello%20world!", [2]string{"X-Hub-Token", "other"}, http.StatusOK, "||"},
+	} {
+		req := httptest.NewRequest("GET", "http://app.kish.test"+c.url, nil)
+		if c.header[0] != "" {
+			req.Header.Set(c.header[0], c.header[1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.code || (c.code == http.StatusOK && rec.Body.String() != c.body) {
+			t.Errorf("%s %v: %d %q", c.url, c.header, rec.Code, rec.Body.String())
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://app.kish.test/", nil))
+	if rec.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("WWW-Authenticate is unexpected: %s", rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestTokenAuthValidate(t *testing.T) {
+	for _, c := range []struct {
+		ta TokenAuth
+		ok bool
+	}{
+		{TokenAuth{Header: "X-Token", Value: "v"}, true},
+		{TokenAuth{Query: "token", Value: "v"}, true},
+		{TokenAuth{Header: "X-Token"}, false},
+		{TokenAuth{Value: "v"}, false},
+		{TokenAuth{Header: "X-Token", Query: "token", Value: "v"}, false},
+		{TokenAuth{Header: "host", Value: "v"}, false},
+		{TokenAuth{Header: "X-Token", Value: "$unknown$v"}, false},
+	} {
+		if err := c.ta.validate(); (err == nil) != c.ok {
+			t.Errorf("validate(%+v) = %v", c.ta, err)
+		}
+	}
+}
+
+func TestRemoveQueryParam(t *testing.T) {
+	for in, out := range map[string]string{
+		"":                     "",
+		"token=x":              "",
+		"a=1&token=x&b=2":      "a=1&b=2",
+		"a=1&to%6Ben=x&b":      "a=1&b",
+		"tokens=x&token&c=%3D": "tokens=x&c=%3D",
+	} {
+		if got := removeQueryParam(in, "token"); got != out {
+			t.Errorf("removeQueryParam(%q) = %q", in, got)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package kish
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/hashicorp/yamux"
+)
+
+const maxUDPPayload = 65535
+
+// 覚えておく訪問者の数。超えたら最後に受信してから一番時間がたったものを忘れる
+const maxUDPPeers = 4096
+
+var ErrUDPFrameTooLarge = errors.New("udp frame is too large")
+
+// yamuxのストリーム上でUDPのデータグラムを送るための形式
+// [アドレス長(2byte)][アドレス("host:port")][ペイロード長(2byte)][ペイロード]
+func WriteUDPFrame(w io.Writer, addr string, payload []byte) error {
+	if len(addr) > 0xffff || len(payload) > maxUDPPayload {
+		return ErrUDPFrameTooLarge
+	}
+	buf := make([]byte, 0, 4+len(addr)+len(payload))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(addr)))
+	buf = append(buf, addr...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	buf = append(buf, payload...)
+	// yamuxのStream.Writeは1回の呼び出しの中ではロックされるので、1回で書けば複数goroutineから書いてもフレームが混ざらない
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadUDPFrame(r io.Reader) (string, []byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return "", nil, err
+	}
+	addr := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", nil, err
+	}
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return "", nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	return string(addr), payload, nil
+}
+
+// 公開ポートにデータを送ってきた訪問者。
+// クライアントは返信しかできないようにし、任意の宛先に送る中継にならないようにする。
+// 送信元は偽装できるので、新しい訪問者が来るたびに全体を走査しないように受信順のリストで古いものを忘れる
+type udpPeers struct {
+	mu    sync.Mutex
+	peers map[string]*list.Element
+	// 先頭が最後に受信した訪問者。Valueはnet.Addr
+	order *list.List
+}
+
+func newUDPPeers() *udpPeers {
+	return &udpPeers{peers: map[string]*list.Element{}, order: list.New()}
+}
+
+func (up *udpPeers) add(addr net.Addr) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	key := addr.String()
+	if e, ok := up.peers[key]; ok {
+		up.order.MoveToFront(e)
+		return
+	}
+	if up.order.Len() >= maxUDPPeers {
+		oldest := up.order.Back()
+		up.order.Remove(oldest)
+		delete(up.peers, oldest.Value.(net.Addr).String())
+	}
+	up.peers[key] = up.order.PushFront(addr)
+}
+
+// 名前解決はしない。ReadFromで得たアドレスの文字列と完全に一致するものだけ
+func (up *udpPeers) lookup(addr string) (net.Addr, bool) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	e, ok := up.peers[addr]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(net.Addr), true
+}
+
+func (rs *KishServer) runUdp(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	claims, err := rs.authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !rs.allowFeature(w, claims, FeatureUDP) {
+		return
+	}
+	defer claims.closeAtDeadline(cancel)()
+	logger := claims.logger()
+
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		logger.Error("net.ListenPacket failed", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer pc.Close()
+
+	respHeader := claims.responseHeader()
+	respHeader.Set("X-Kish-URL", "udp://"+pc.LocalAddr().String())
+
+	c, err := websocketUpgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		logger.Warn("websocket upgrade failed", "err", err)
+		return
+	}
+	defer c.Close()
+
+	rwc := newCountingRWC(MakeRWC(c))
+	session, err := yamux.Server(rwc, nil)
+	if err != nil {
+		logger.Error("yamux.Server failed", "err", err)
+		return
+	}
+	defer session.Close()
+	go func() {
+		<-session.CloseChan()
+		logger.Debug("yamux session closed")
+		cancel()
+	}()
+	stream, err := session.Open()
+	if err != nil {
+		logger.Warn("session.Open failed", "err", err)
+		return
+	}
+	defer stream.Close()
+	logger = logger.With("tunnel", "udp://"+pc.LocalAddr().String())
+	logger.Info("tunnel has been established")
+	defer logger.Info("tunnel has been closed")
+	defer rs.auditTunnel(r, claims, nil, AuditEvent{Type: FeatureUDP, Addr: pc.LocalAddr().String()}, rwc)()
+	peers := newUDPPeers()
+	go forwardFromPacketConnToStream(pc, stream, peers, cancel)
+	go forwardFromStreamToPacketConn(stream, pc, peers, cancel)
+	<-ctx.Done()
+}
+
+func forwardFromPacketConnToStream(pc net.PacketConn, stream io.Writer, peers *udpPeers, cancel func()) {
+	defer cancel()
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("ReadFrom failed", "err", err)
+			}
+			return
+		}
+		peers.add(addr)
+		if err := WriteUDPFrame(stream, addr.String(), buf[:n]); err != nil {
+			slog.Debug("WriteUDPFrame failed", "err", err)
+			return
+		}
+	}
+}
+
+func forwardFromStreamToPacketConn(stream io.Reader, pc net.PacketConn, peers *udpPeers, cancel func()) {
+	defer cancel()
+	for {
+		addrStr, payload, err := ReadUDPFrame(stream)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("ReadUDPFrame failed", "err", err)
+			}
+			return
+		}
+		addr, ok := peers.lookup(addrStr)
+		if !ok {
+			slog.Debug("drop a frame to unknown peer", "addr", addrStr)
+			continue
+		}
+		if _, err := pc.WriteTo(payload, addr); err != nil {
+			slog.Debug("WriteTo failed", "err", err)
+		}
+	}
+}
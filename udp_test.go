@@ -0,0 +1,110 @@
+package kish
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPFrameRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	frames := []struct {
+		addr    string
+		payload []byte
+	}{
+		{"192.0.2.1:53", []byte("query")},
+		{"[2001:db8::1]:12345", []byte{}},
+		{"198.51.100.7:9", bytes.Repeat([]byte{0xff}, maxUDPPayload)},
+	}
+	for _, f := range frames {
+		if err := WriteUDPFrame(buf, f.addr, f.payload); err != nil {
+			t.Fatalf("WriteUDPFrame: %+v", err)
+		}
+	}
+	for _, f := range frames {
+		addr, payload, err := ReadUDPFrame(buf)
+		if err != nil {
+			t.Fatalf("ReadUDPFrame: %+v", err)
+		}
+		if addr != f.addr || !bytes.Equal(payload, f.payload) {
+			t.Errorf("frame is unexpected: %s %d", addr, len(payload))
+		}
+	}
+	if _, _, err := ReadUDPFrame(buf); !errors.Is(err, io.EOF) {
+		t.Errorf("err is unexpected: %+v", err)
+	}
+}
+
+func TestUDPFrameTooLarge(t *testing.T) {
+	err := WriteUDPFrame(io.Discard, "192.0.2.1:53", make([]byte, maxUDPPayload+1))
+	if !errors.Is(err, ErrUDPFrameTooLarge) {
+		t.Errorf("err is unexpected: %+v", err)
+	}
+}
+
+func TestUDPRelayOnlyToPeers(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	visitor, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	peers := newUDPPeers()
+	toClient, fromVisitor := io.Pipe()
+	go forwardFromPacketConnToStream(pc, fromVisitor, peers, func() {})
+	if _, err := visitor.WriteTo([]byte("ping"), pc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	addr, payload, err := ReadUDPFrame(toClient)
+	if err != nil || string(payload) != "ping" {
+		t.Fatalf("ReadUDPFrame: %s %q %+v", addr, payload, err)
+	}
+
+	// 訪問者でない宛先には送らない
+	frames := new(bytes.Buffer)
+	WriteUDPFrame(frames, other.LocalAddr().String(), []byte("attack"))
+	WriteUDPFrame(frames, "localhost:9", []byte("attack"))
+	WriteUDPFrame(frames, addr, []byte("pong"))
+	forwardFromStreamToPacketConn(frames, pc, peers, func() {})
+
+	buf := make([]byte, 100)
+	visitor.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := visitor.ReadFrom(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("visitor: %q %+v", buf[:n], err)
+	}
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := other.ReadFrom(buf); err == nil {
+		t.Errorf("other peer received %q", buf[:n])
+	}
+}
+
+func TestUDPPeersEvictOldest(t *testing.T) {
+	peers := newUDPPeers()
+	for i := 0; i < maxUDPPeers; i++ {
+		peers.add(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: i + 1})
+	}
+	// 最初のものを使い直すと、2番目が一番古くなる
+	peers.add(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1})
+	peers.add(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1})
+	if _, ok := peers.lookup("192.0.2.1:2"); ok {
+		t.Errorf("oldest peer should be evicted")
+	}
+	for _, addr := range []string{"192.0.2.1:1", "192.0.2.1:3", "198.51.100.1:1"} {
+		if _, ok := peers.lookup(addr); !ok {
+			t.Errorf("%s should be kept", addr)
+		}
+	}
+}
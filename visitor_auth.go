@@ -0,0 +1,134 @@
+package kish
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 認証した訪問者をターゲットに知らせるヘッダー
+var identityHeaders = []string{"X-Forwarded-User", "X-Forwarded-Email", "X-Forwarded-Groups"}
+
+func (p *proxy2Struct) requiresAuth() bool {
+	return p.hasCredentials() || p.oidc != nil
+}
+
+// リクエストごとに資格情報を送ってくる方式
+func (p *proxy2Struct) hasCredentials() bool {
+	return len(p.basicAuth) > 0 || len(p.apiKeys) > 0 || len(p.tokenAuth) > 0 || p.jwt != nil
+}
+
+// 認証が不要か、いずれかの方法で認証できればtrue。できなければレスポンスを書いてfalseを返す
+func (p *proxy2Struct) authorize(w http.ResponseWriter, req *http.Request, remoteIP string) (ok bool) {
+	if !p.requiresAuth() {
+		return true
+	}
+	// 訪問者が付けてきたものをターゲットが信じないように消す
+	for _, h := range identityHeaders {
+		req.Header.Del(h)
+	}
+	if p.jwt != nil {
+		p.jwt.stripForwardHeaders(req)
+	}
+	defer func() {
+		if ok {
+			p.stripTokens(req)
+		}
+	}()
+	if p.hasShareCookie(req) {
+		return true
+	}
+	if p.oidc != nil {
+		if id, ok := p.oidcProvider.sessionIdentity(req, p.host, p.oidc); ok {
+			req.Header.Set("X-Forwarded-User", id.Email)
+			req.Header.Set("X-Forwarded-Email", id.Email)
+			if len(id.Groups) > 0 {
+				req.Header.Set("X-Forwarded-Groups", strings.Join(id.Groups, ","))
+			}
+			return true
+		}
+	}
+	if p.login != nil {
+		if user, ok := p.loginUser(req); ok {
+			req.Header.Set("X-Forwarded-User", user)
+			return true
+		}
+	}
+	if p.hasCredentials() {
+		if wait, locked := p.limiter.locked(remoteIP, time.Now()); locked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "Too many authentication failures", http.StatusTooManyRequests)
+			return false
+		}
+		_, _, basicPresented := req.BasicAuth()
+		if len(p.basicAuth) > 0 && p.checkAuth(req) {
+			p.limiter.succeed(remoteIP)
+			return true
+		}
+		tokenOK, tokenPresented := p.checkToken(req)
+		if tokenOK {
+			p.limiter.succeed(remoteIP)
+			return true
+		}
+		var jwtPresented bool
+		if p.jwt != nil {
+			var jwtOK bool
+			jwtOK, jwtPresented = p.checkJWT(req)
+			if jwtOK {
+				p.limiter.succeed(remoteIP)
+				return true
+			}
+		}
+		// 資格情報なしの最初のリクエストは失敗に数えない
+		if (len(p.basicAuth) > 0 && basicPresented) || tokenPresented || jwtPresented {
+			p.recordAuthFailure(remoteIP)
+		}
+	}
+	if p.oidc != nil {
+		p.oidcProvider.redirectToLogin(w, req, p.host)
+		return false
+	}
+	if p.login != nil {
+		p.redirectToLoginForm(w, req)
+		return false
+	}
+	if len(p.basicAuth) > 0 {
+		w.Header().Set("WWW-Authenticate", "Basic")
+	} else if len(p.apiKeys) > 0 || p.jwt != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// /.kish/以下でkishが処理したものはtrueを返す。それ以外はターゲットに転送する
+func (p *proxy2Struct) handleReserved(w http.ResponseWriter, req *http.Request, remoteIP string) bool {
+	switch strings.TrimPrefix(req.URL.Path, kishReservedPathPrefix) {
+	case "share":
+		if p.shareKey == nil {
+			return false
+		}
+		p.shareHandler(w, req)
+		return true
+	case "login":
+		if p.login == nil {
+			return false
+		}
+		p.loginHandler(w, req, remoteIP)
+		return true
+	case "logout":
+		if p.login == nil {
+			return false
+		}
+		p.logoutHandler(w, req)
+		return true
+	case "oidc":
+		if p.oidc == nil {
+			return false
+		}
+		p.oidcProvider.ticketHandler(w, req, p.host, p.oidc)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package kish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// 訪問者がAuthorization: Bearerで送ってくるJWTの検証方法
+type JWTParameters struct {
+	// JWKSURLかJWKSのどちらか一方。JWKSはクライアント側のファイルの中身
+	JWKSURL  string          `json:"jwksURL,omitempty"`
+	JWKS     json.RawMessage `json:"jwks,omitempty"`
+	Issuer   string          `json:"issuer,omitempty"`
+	Audience string          `json:"audience,omitempty"`
+	// 値が一致しなければならないクレーム。値が空なら存在だけを確認する
+	RequiredClaims map[string]string `json:"requiredClaims,omitempty"`
+	// クレーム名からヘッダー名への対応。ターゲットにはこのヘッダーで渡す
+	ForwardClaims map[string]string `json:"forwardClaims,omitempty"`
+}
+
+var (
+	ErrInvalidJWTParameters = errors.New("jwt auth needs either jwksURL or jwks")
+	ErrJWKSURLNotHTTPS      = errors.New("jwksURL must be https")
+	ErrJWKSURLNotAllowed    = errors.New("jwksURL is not allowed by the server")
+	ErrJWKSEmpty            = errors.New("jwks has no usable key")
+	ErrInvalidForwardHeader = errors.New("invalid header name to forward claim")
+	ErrRequiredClaim        = errors.New("required claim is missing or mismatched")
+)
+
+const jwksFetchTimeout = 10 * time.Second
+
+var headerNameRegexp = regexp.MustCompile("^[-!#$%&'*+.^_`|~0-9A-Za-z]+$")
+
+func (jp *JWTParameters) validate() error {
+	if (jp.JWKSURL == "") == (len(jp.JWKS) == 0) {
+		return ErrInvalidJWTParameters
+	}
+	if jp.JWKSURL != "" {
+		u, err := url.Parse(jp.JWKSURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return ErrJWKSURLNotHTTPS
+		}
+	}
+	for _, h := range jp.ForwardClaims {
+		if !headerNameRegexp.MatchString(h) {
+			return ErrInvalidForwardHeader
+		}
+		for _, reserved := range reservedTokenHeaders {
+			if strings.EqualFold(h, reserved) {
+				return ErrInvalidForwardHeader
+			}
+		}
+	}
+	return nil
+}
+
+// サーバーが内部のネットワークを取りに行かされないように、許可されたURLだけを使う。
+// 許可するURLが"/"で終わっていればその下のパス全部、そうでなければそのURLだけを許す
+func jwksURLAllowed(jwksURL string, allow []string) bool {
+	u, err := url.Parse(jwksURL)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	for _, a := range allow {
+		au, err := url.Parse(a)
+		if err != nil || au.Scheme != "https" || !strings.EqualFold(u.Host, au.Host) {
+			continue
+		}
+		if u.Path == au.Path || (strings.HasSuffix(au.Path, "/") && strings.HasPrefix(u.Path, au.Path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// JWKSが指定されていればここで読む。URLの場合は最初の訪問者が来たときに取りに行く
+func (jp *JWTParameters) newKeySet(client *http.Client) (*jwksCache, error) {
+	if jp.JWKSURL != "" {
+		if client == nil {
+			client = &http.Client{
+				Timeout: jwksFetchTimeout,
+				// 許可したURLから別の場所へ飛ばされないように
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			}
+		}
+		return newJWKSCache(jp.JWKSURL, client), nil
+	}
+	c, err := newStaticJWKS(jp.JWKS)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.keys) == 0 {
+		return nil, ErrJWKSEmpty
+	}
+	return c, nil
+}
+
+type visitorJWT struct {
+	params *JWTParameters
+	keys   *jwksCache
+}
+
+func (v *visitorJWT) verify(ctx context.Context, token string) (jwt.MapClaims, error) {
+	opts := []jwt.ParserOption{jwt.WithExpirationRequired()}
+	if v.params.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.params.Issuer))
+	}
+	if v.params.Audience != "" {
+		opts = append(opts, jwt.WithAudience(v.params.Audience))
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, v.keys.keyfunc(ctx), opts...); err != nil {
+		return nil, err
+	}
+	for name, want := range v.params.RequiredClaims {
+		if !claimMatches(claims[name], want) {
+			return nil, fmt.Errorf("%w: %s", ErrRequiredClaim, name)
+		}
+	}
+	return claims, nil
+}
+
+// 配列ならいずれかの要素が一致すればよい
+func claimMatches(v interface{}, want string) bool {
+	if v == nil {
+		return false
+	}
+	if want == "" {
+		return true
+	}
+	if a, ok := v.([]interface{}); ok {
+		for _, e := range a {
+			if claimMatches(e, want) {
+				return true
+			}
+		}
+		return false
+	}
+	return claimString(v) == want
+}
+
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []interface{}:
+		s := make([]string, 0, len(v))
+		for _, e := range v {
+			s = append(s, claimString(e))
+		}
+		return strings.Join(s, ",")
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// 訪問者が付けてきたものをターゲットが信じないように、クレームを渡すヘッダーは常に消す
+func (v *visitorJWT) stripForwardHeaders(req *http.Request) {
+	for _, h := range v.params.ForwardClaims {
+		req.Header.Del(h)
+	}
+}
+
+func (v *visitorJWT) forwardClaims(req *http.Request, claims jwt.MapClaims) {
+	for name, h := range v.params.ForwardClaims {
+		if c, ok := claims[name]; ok {
+			req.Header.Set(h, claimString(c))
+		}
+	}
+}
+
+// JWTが送られてきていなければpresentedはfalse
+func (p *proxy2Struct) checkJWT(req *http.Request) (ok bool, presented bool) {
+	token, exist := bearerToken(req)
+	// API keyと併用している場合、JWTの形をしていないものはAPI keyとして扱われている
+	if !exist || strings.Count(token, ".") != 2 {
+		return false, false
+	}
+	claims, err := p.jwt.verify(req.Context(), token)
+	if err != nil {
+		p.log().Info("JWT is rejected", "err", err)
+		return false, true
+	}
+	p.jwt.forwardClaims(req, claims)
+	return true, true
+}
@@ -0,0 +1,231 @@
+package kish
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func ecJWKS(t *testing.T, kid string, key *ecdsa.PrivateKey) []byte {
+	b, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": kid,
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func signVisitorJWT(t *testing.T, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVisitorJWT(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwksServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(ecJWKS(t, "k1", key))
+	}))
+	defer jwksServer.Close()
+
+	jp := &JWTParameters{
+		JWKSURL:        jwksServer.URL + "/jwks.json",
+		Issuer:         "https://app.example.com",
+		Audience:       "preview",
+		RequiredClaims: map[string]string{"role": "tester", "sub": ""},
+		ForwardClaims:  map[string]string{"sub": "X-User-Id", "groups": "X-User-Groups"},
+	}
+	if err := jp.validate(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jp.newKeySet(jwksServer.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy2Struct{
+		host:    "app.kish.test",
+		jwt:     &visitorJWT{params: jp, keys: keys},
+		limiter: newAuthLimiter(),
+		events:  newEventSink(),
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if p.authorize(w, req, "192.0.2.1") {
+			w.Write([]byte(req.Header.Get("X-User-Id") + "|" + req.Header.Get("X-User-Groups")))
+		}
+	})
+
+	valid := jwt.MapClaims{
+		"iss":    "https://app.example.com",
+		"aud":    "preview",
+		"sub":    "u1",
+		"role":   []string{"dev", "tester"},
+		"groups": []string{"a", "b"},
+		"exp":    time.Now().Add(time.Minute).Unix(),
+	}
+	with := func(k string, v interface{}) jwt.MapClaims {
+		c := jwt.MapClaims{}
+		for kk, vv := range valid {
+			c[kk] = vv
+		}
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	for name, c := range map[string]struct {
+		token string
+		code  int
+	}{
+		"valid":        {signVisitorJWT(t, key, "k1", valid), http.StatusOK},
+		"none":         {"", http.StatusUnauthorized},
+		"wrong key":    {signVisitorJWT(t, otherKey, "k1", valid), http.StatusUnauthorized},
+		"wrong issuer": {signVisitorJWT(t, key, "k1", with("iss", "https://evil.example.com")), http.StatusUnauthorized},
+		"wrong aud":    {signVisitorJWT(t, key, "k1", with("aud", "other")), http.StatusUnauthorized},
+		"expired":      {signVisitorJWT(t, key, "k1", with("exp", time.Now().Add(-time.Minute).Unix())), http.StatusUnauthorized},
+		"no exp":       {signVisitorJWT(t, key, "k1", with("exp", nil)), http.StatusUnauthorized},
+		"wrong role":   {signVisitorJWT(t, key, "k1", with("role", "dev")), http.StatusUnauthorized},
+		"no sub":       {signVisitorJWT(t, key, "k1", with("sub", nil)), http.StatusUnauthorized},
+		"not a jwt":    {"abc", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "http://app.kish.test/", nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		req.Header.Set("X-User-Id", "spoofed")
+		// 失敗が続いてロックされないように
+		p.limiter = newAuthLimiter()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("%s: status is unexpected: %d", name, rec.Code)
+		}
+		if c.code == http.StatusOK && rec.Body.String() != "u1|a,b" {
+			t.Errorf("%s: claims are not forwarded: %s", name, rec.Body.String())
+		}
+	}
+}
+
+func TestVisitorJWTStaticJWKS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jp := &JWTParameters{JWKS: ecJWKS(t, "k1", key)}
+	if err := jp.validate(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jp.newKeySet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &visitorJWT{params: jp, keys: keys}
+	token := signVisitorJWT(t, key, "k1", jwt.MapClaims{"exp": time.Now().Add(time.Minute).Unix()})
+	if _, err := v.verify(t.Context(), token); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJWTParametersValidate(t *testing.T) {
+	jwks := json.RawMessage(`{"keys":[]}`)
+	for _, c := range []struct {
+		jp JWTParameters
+		ok bool
+	}{
+		{JWTParameters{JWKSURL: "https://example.com/jwks"}, true},
+		{JWTParameters{JWKS: jwks}, true},
+		{JWTParameters{}, false},
+		{JWTParameters{JWKSURL: "https://example.com/jwks", JWKS: jwks}, false},
+		{JWTParameters{JWKSURL: "http://example.com/jwks"}, false},
+		{JWTParameters{JWKSURL: "file:///etc/passwd"}, false},
+		{JWTParameters{JWKS: jwks, ForwardClaims: map[string]string{"sub": "Host"}}, false},
+		{JWTParameters{JWKS: jwks, ForwardClaims: map[string]string{"sub": "X-User\r\nX-Evil"}}, false},
+	} {
+		if err := c.jp.validate(); (err == nil) != c.ok {
+			t.Errorf("validate(%+v) = %v", c.jp, err)
+		}
+	}
+	if _, err := (&JWTParameters{JWKS: jwks}).newKeySet(nil); err != ErrJWKSEmpty {
+		t.Errorf("empty JWKS is accepted: %v", err)
+	}
+}
+
+func TestJWKSURLAllowed(t *testing.T) {
+	allow := []string{"https://login.example.com/keys/", "https://idp.example.com/jwks.json"}
+	for u, want := range map[string]bool{
+		"https://login.example.com/keys/a.json":  true,
+		"https://LOGIN.example.com/keys/a.json":  true,
+		"https://login.example.com/other.json":   false,
+		"https://idp.example.com/jwks.json":      true,
+		"https://idp.example.com/jwks.json/x":    false,
+		"https://idp.example.com.evil/jwks.json": false,
+		"https://x@idp.example.com/jwks.json":    false,
+		"http://idp.example.com/jwks.json":       false,
+		"https://169.254.169.254/latest":         false,
+	} {
+		if got := jwksURLAllowed(u, allow); got != want {
+			t.Errorf("%s: %v", u, got)
+		}
+	}
+	if jwksURLAllowed("https://idp.example.com/jwks.json", nil) {
+		t.Errorf("URL is allowed without allowlist")
+	}
+}
+
+func TestJWKSCacheFetchOnce(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	jwksServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		w.Write(ecJWKS(t, "k1", key))
+	}))
+	defer jwksServer.Close()
+	c := newJWKSCache(jwksServer.URL, jwksServer.Client())
+
+	// 取得中でも、諦めた訪問者はすぐに戻れる
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.lookup(ctx, "k1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected: %v", err)
+	}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if keys, err := c.lookup(t.Context(), "k1"); err != nil || len(keys) != 1 {
+				t.Errorf("lookup: %v %v", keys, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetched %d times", n)
+	}
+}